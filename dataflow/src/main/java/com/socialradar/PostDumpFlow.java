@@ -1,5 +1,7 @@
 package com.socialradar;
 
+import com.google.api.client.json.jackson2.JacksonFactory;
+import com.google.api.client.util.Key;
 import com.google.api.services.bigquery.model.TableFieldSchema;
 import com.google.api.services.bigquery.model.TableRow;
 import com.google.api.services.bigquery.model.TableSchema;
@@ -16,6 +18,9 @@ import com.google.cloud.dataflow.sdk.values.PCollection;
 import org.apache.hadoop.hbase.client.Result;
 import org.apache.hadoop.hbase.util.Bytes;
 
+import java.io.IOException;
+import java.io.InputStream;
+import java.io.Serializable;
 import java.nio.charset.Charset;
 import java.util.ArrayList;
 import java.util.List;
@@ -30,8 +35,64 @@ public class PostDumpFlow {
     private static final String BQ_DATASET_ID = "post_analysis";
     private static final String BQ_TABLE_NAME = "daily_dump_1";
     private static final Charset UTF8_CHARSET = Charset.forName("UTF-8");
-            
-    public static void main(String[] args) {
+    // Written by the Go service from its postSchema (see service/btschema.go), bundled into the jar.
+    private static final String SCHEMA_RESOURCE = "/post_schema.json";
+
+    // The parts of post_schema.json this job needs.
+    public static class PostSchema {
+        @Key public List<Column> columns;
+    }
+
+    // One BigTable column of a post row, and the BigQuery column it goes to.
+    public static class Column implements Serializable {
+        @Key public String family;
+        @Key public String column;
+        @Key public String field;  // BigQuery column name.
+        @Key public String type;   // BigQuery type: STRING, FLOAT or TIMESTAMP.
+    }
+
+    static PostSchema loadSchema() throws IOException {
+        try (InputStream in = PostDumpFlow.class.getResourceAsStream(SCHEMA_RESOURCE)) {
+            if (in == null) {
+                throw new IOException(SCHEMA_RESOURCE + " is missing from the classpath");
+            }
+            return JacksonFactory.getDefaultInstance().fromInputStream(in, UTF8_CHARSET, PostSchema.class);
+        }
+    }
+
+    // Turns a BigTable post row into a BigQuery row with a column per schema column. Rows written by
+    // older schema versions lack some columns, those are left null.
+    static class RowToTableRow extends DoFn<Result, TableRow> {
+        private final ArrayList<Column> columns;
+
+        RowToTableRow(List<Column> columns) {
+            this.columns = new ArrayList<>(columns);
+        }
+
+        @Override
+        public void processElement(ProcessContext c) {
+            Result result = c.element();
+            TableRow row = new TableRow();//BQ Table row object.
+            row.set("postId", new String(result.getRow(), UTF8_CHARSET));
+            for (Column col : columns) {
+                byte[] value = result.getValue(Bytes.toBytes(col.family), Bytes.toBytes(col.column));
+                if (value == null) {
+                    continue;
+                }
+                String text = new String(value, UTF8_CHARSET);
+                if ("FLOAT".equals(col.type)) {
+                    row.set(col.field, Double.parseDouble(text));
+                } else {
+                    row.set(col.field, text);  // STRING, and TIMESTAMP which is written in a format BigQuery parses.
+                }
+            }
+            c.output(row);
+        }
+    }
+
+    public static void main(String[] args) throws IOException {
+        PostSchema postSchema = loadSchema();
+
         // Start by defining the options for the pipeline.
         PipelineOptions options = PipelineOptionsFactory.fromArgs(args).create();
 
@@ -47,33 +108,16 @@ public class PostDumpFlow {
         // Get result from BigTable (one row of result is one row of data in BigTable).
         PCollection<Result> btRows = p.apply(Read.from(CloudBigtableIO.read(config)));
 
-        // Transform each row of BigTable data to rows of data in BigQuery. 
-        PCollection<TableRow> bqRows = btRows.apply(ParDo.of(new DoFn<Result, TableRow>() {
-            @Override
-            public void processElement(ProcessContext c) {
-                Result result = c.element();
-                String postId = new String(result.getRow());
-                String user = new String(result.getValue(Bytes.toBytes("post"), Bytes.toBytes("user")), UTF8_CHARSET);
-                String message = new String(result.getValue(Bytes.toBytes("post"), Bytes.toBytes("message")), UTF8_CHARSET);
-                String lat = new String(result.getValue(Bytes.toBytes("location"), Bytes.toBytes("lat")), UTF8_CHARSET);
-                String lon = new String(result.getValue(Bytes.toBytes("location"), Bytes.toBytes("lon")), UTF8_CHARSET);
-                TableRow row = new TableRow();//BQ Table row object.
-                row.set("postId", postId);
-                row.set("user", user);
-                row.set("message", message);
-                row.set("lat", Double.parseDouble(lat));
-                row.set("lon", Double.parseDouble(lon));
-                c.output(row);
-            }
-        }));
+        // Transform each row of BigTable data to rows of data in BigQuery, one column per column of the
+        // schema the Go service writes.
+        PCollection<TableRow> bqRows = btRows.apply(ParDo.of(new RowToTableRow(postSchema.columns)));
 
         // Create schema for BigQuery since it is a relational database.
         List<TableFieldSchema> fields = new ArrayList<>();
         fields.add(new TableFieldSchema().setName("postId").setType("STRING"));  // define various columns.
-        fields.add(new TableFieldSchema().setName("user").setType("STRING"));
-        fields.add(new TableFieldSchema().setName("message").setType("STRING"));
-        fields.add(new TableFieldSchema().setName("lat").setType("FLOAT"));
-        fields.add(new TableFieldSchema().setName("lon").setType("FLOAT"));
+        for (Column col : postSchema.columns) {
+            fields.add(new TableFieldSchema().setName(col.field).setType(col.type));
+        }
 
         TableSchema schema = new TableSchema().setFields(fields);
 
@@ -0,0 +1,491 @@
+package main
+
+// This module lets users save areas, such as their home or office, and be told about new posts there:
+//
+//	POST   /api/v1/areas        save an area
+//	GET    /api/v1/areas        your saved areas
+//	DELETE /api/v1/areas/{id}   stop watching an area
+//
+// An area has a name and either a circle {"lat", "lon", "range"} (range in kilometers, up to
+// MAX_AREA_RANGE_KM) or a polygon, a list of at least 3 {"lat", "lon"} points that fits in a box of
+// 2 * MAX_AREA_RANGE_KM a side. Like /stream it may only want posts with some of the
+// keywords, a min_face score or a type. Areas are stored in the alert index as geo_shapes, so matching
+// a new post is one geo_shape query that ES answers from its spatial index. handlerPost only queues the
+// post, workers match it and record a Notification for each area (see notification.go).
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+	"github.com/olivere/elastic"
+	"github.com/pborman/uuid"
+)
+
+const (
+	ALERT_INDEX = "alert"
+	ALERT_TYPE  = "alert"
+
+	MAX_SAVED_AREAS      = 20   // per user.
+	MAX_AREA_RANGE_KM    = 50.0 // radius of a circle, and half the width or height of a polygon.
+	MAX_AREA_NAME_LENGTH = 50
+	MAX_POLYGON_POINTS   = 100
+	MAX_KEYWORDS         = 10
+	MAX_KEYWORD_LENGTH   = 50
+
+	ALERT_QUEUE_SIZE = 1000 // posts waiting to be matched, more are put in the outbox.
+	ALERT_WORKERS    = 4
+	ALERT_BATCH_SIZE = 500 // saved areas read per page when a post matches many.
+)
+
+var (
+	alertsMatched = expvar.NewInt("alerts_matched")
+	alertsFailed  = expvar.NewInt("alerts_failed")
+)
+
+// Circle is an area around a location, Range is in kilometers.
+type Circle struct {
+	Lat   float64 `json:"lat"`
+	Lon   float64 `json:"lon"`
+	Range float64 `json:"range"`
+}
+
+// SavedArea is an area a user wants to hear about.
+type SavedArea struct {
+	Id       string     `json:"id"`
+	User     string     `json:"user"`
+	Name     string     `json:"name"`
+	Circle   *Circle    `json:"circle,omitempty"`
+	Polygon  []Location `json:"polygon,omitempty"`
+	Keywords []string   `json:"keywords,omitempty"` // any one of them has to be in the message.
+	StreamFilter
+	Created time.Time `json:"created"`
+
+	// The area as GeoJSON, what ES matches posts against. Not shown to clients.
+	Shape map[string]interface{} `json:"shape,omitempty"`
+}
+
+// AreaList is the answer of GET /areas.
+type AreaList struct {
+	Areas []SavedArea `json:"areas"`
+}
+
+// Handler for GET and POST on /areas.
+func handlerAreas(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
+	w.Header().Set("Access-Control-Allow-Methods", "GET,POST")
+
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	user := getUsername(r)
+	if r.Method == "GET" {
+		areas, err := listAreas(r.Context(), esClient, user)
+		if err != nil {
+			writeError(w, r, internalError("Failed to read areas from ElasticSearch", err))
+			return
+		}
+		js, err := json.Marshal(AreaList{Areas: areas})
+		if err != nil {
+			writeError(w, r, internalError("Failed to parse areas into JSON format", err))
+			return
+		}
+		w.Write(js)
+		return
+	}
+
+	fmt.Printf("Received one saved area from %s\n", user)
+	var a SavedArea
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		writeError(w, r, badRequest("invalid_json", "Failed to parse JSON input from client", err))
+		return
+	}
+	a.User = user
+	if err := a.validate(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := saveArea(r.Context(), esClient, &a); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	js, err := json.Marshal(a)
+	if err != nil {
+		writeError(w, r, internalError("Failed to parse area into JSON format", err))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
+}
+
+// Handler for DELETE /areas/{id}, answers 204.
+func handlerArea(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
+	w.Header().Set("Access-Control-Allow-Methods", "DELETE")
+
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	if err := deleteArea(r.Context(), esClient, mux.Vars(r)["id"], getUsername(r)); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Check an area sent by a client and fill in its shape.
+func (a *SavedArea) validate() error {
+	var v ValidationError
+	a.Name = strings.TrimSpace(a.Name)
+	if a.Name == "" {
+		v.Add("name", "is required")
+	}
+	v.Text("name", a.Name, MAX_AREA_NAME_LENGTH)
+
+	switch {
+	case a.Circle != nil && a.Polygon != nil:
+		v.Add("polygon", "cannot be given together with circle")
+	case a.Circle != nil:
+		c := a.Circle
+		if !(c.Lat >= -90 && c.Lat <= 90) {
+			v.Add("circle.lat", "must be between -90 and 90")
+		}
+		if !(c.Lon >= -180 && c.Lon <= 180) {
+			v.Add("circle.lon", "must be between -180 and 180")
+		}
+		if !(c.Range > 0 && c.Range <= MAX_AREA_RANGE_KM) {
+			v.Add("circle.range", fmt.Sprintf("must be greater than 0 and at most %g", MAX_AREA_RANGE_KM))
+		}
+		a.Shape = map[string]interface{}{
+			"type":        "circle",
+			"coordinates": []float64{c.Lon, c.Lat},
+			"radius":      strconv.FormatFloat(c.Range, 'f', -1, 64) + "km",
+		}
+	case a.Polygon != nil:
+		// GeoJSON rings are closed and list longitude first.
+		ring := make([][]float64, 0, len(a.Polygon)+1)
+		for _, l := range a.Polygon {
+			if !(l.Lat >= -90 && l.Lat <= 90 && l.Lon >= -180 && l.Lon <= 180) {
+				v.Add("polygon", "has a point outside of -90..90, -180..180")
+				break
+			}
+			ring = append(ring, []float64{l.Lon, l.Lat})
+		}
+		if len(ring) > 0 && a.Polygon[0] != a.Polygon[len(a.Polygon)-1] {
+			ring = append(ring, ring[0])
+		}
+		if n := len(ring) - 1; n < 3 || n > MAX_POLYGON_POINTS {
+			v.Add("polygon", fmt.Sprintf("must have between 3 and %d points", MAX_POLYGON_POINTS))
+		} else if polygonTooLarge(a.Polygon) {
+			v.Add("polygon", fmt.Sprintf("must fit in %g by %g km", 2*MAX_AREA_RANGE_KM, 2*MAX_AREA_RANGE_KM))
+		}
+		a.Shape = map[string]interface{}{"type": "polygon", "coordinates": [][][]float64{ring}}
+	default:
+		v.Add("circle", "is required, or polygon")
+	}
+
+	if len(a.Keywords) > MAX_KEYWORDS {
+		v.Add("keywords", fmt.Sprintf("must be at most %d", MAX_KEYWORDS))
+	}
+	for i, k := range a.Keywords {
+		a.Keywords[i] = v.Text("keywords", strings.TrimSpace(k), MAX_KEYWORD_LENGTH)
+		if a.Keywords[i] == "" {
+			v.Add("keywords", "must not be empty")
+		}
+	}
+	if err := a.StreamFilter.validate(); err != nil {
+		v.Fields = append(v.Fields, err.(*ValidationError).Fields...)
+	}
+	return v.Err()
+}
+
+// Check if the bounding box of a polygon is wider or higher than 2 * MAX_AREA_RANGE_KM, measuring degrees
+// of longitude as at the equator.
+func polygonTooLarge(points []Location) bool {
+	minLat, maxLat, minLon, maxLon := 90.0, -90.0, 180.0, -180.0
+	for _, l := range points {
+		minLat, maxLat = math.Min(minLat, l.Lat), math.Max(maxLat, l.Lat)
+		minLon, maxLon = math.Min(minLon, l.Lon), math.Max(maxLon, l.Lon)
+	}
+	lonSpan := maxLon - minLon
+	if lonSpan > 180 {
+		lonSpan = 360 - lonSpan // crosses the antimeridian.
+	}
+	max := 2 * MAX_AREA_RANGE_KM / KM_PER_DEGREE
+	return maxLat-minLat > max || lonSpan > max
+}
+
+// Check if the message of p has one of the keywords of a, if it has any. Keywords match whole words,
+// ignoring case and punctuation.
+func (a *SavedArea) matches(p *Post) bool {
+	if len(a.Keywords) == 0 {
+		return true
+	}
+	message := " " + normalizeWords(p.Message) + " "
+	for _, k := range a.Keywords {
+		if k := normalizeWords(k); k != "" && strings.Contains(message, " "+k+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeWords(s string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), " ")
+}
+
+// geoShapeQuery matches the documents whose shape field intersects shape, elastic has no builder for it.
+type geoShapeQuery struct {
+	field string
+	shape interface{}
+}
+
+func (q geoShapeQuery) Source() (interface{}, error) {
+	return map[string]interface{}{
+		"geo_shape": map[string]interface{}{
+			q.field: map[string]interface{}{"shape": q.shape, "relation": "intersects"},
+		},
+	}, nil
+}
+
+// A filter on an optional field of the saved areas: areas without the field pass too.
+func orMissing(field string, q elastic.Query) elastic.Query {
+	return elastic.NewBoolQuery().
+		Should(q, elastic.NewBoolQuery().MustNot(elastic.NewExistsQuery(field))).
+		MinimumNumberShouldMatch(1)
+}
+
+// AlertQueue matches new posts against the saved areas in the background, so that posting never waits
+// for it.
+type AlertQueue struct {
+	posts chan *Post
+}
+
+// The queue handlerPost puts every saved post on.
+var alerts = NewAlertQueue(ALERT_WORKERS)
+
+func NewAlertQueue(workers int) *AlertQueue {
+	q := &AlertQueue{posts: make(chan *Post, ALERT_QUEUE_SIZE)}
+	for i := 0; i < workers; i++ {
+		go q.run()
+	}
+	return q
+}
+
+// Queue a post without blocking. When the queue is full the post goes to the outbox, to be matched later.
+func (q *AlertQueue) Publish(p *Post) {
+	select {
+	case q.posts <- p:
+	default:
+		fmt.Printf("Alert queue is full, post %s is matched later.\n", p.Id)
+		recordOutbox(OutboxEntry{PostId: p.Id, Action: "alerts.match", Post: p, Error: "alert queue is full"})
+	}
+}
+
+func (q *AlertQueue) run() {
+	for p := range q.posts {
+		ctx, cancel := context.WithTimeout(context.Background(), esTimeout*(STEP_RETRIES+1))
+		err := runStep(ctx, "alerts", func(ctx context.Context) error {
+			return matchAlerts(ctx, esClient, p)
+		})
+		cancel()
+		if err != nil {
+			alertsFailed.Add(1)
+			fmt.Printf("Failed to match post %s against saved areas %v.\n", p.Id, err)
+			recordOutbox(OutboxEntry{PostId: p.Id, Action: "alerts.match", Post: p, Error: err.Error()})
+		}
+	}
+}
+
+/**
+ *  Helper functions:
+ */
+// Function that finds the saved areas a post is in and notifies their users. It is safe to run again
+// for the same post: each area notifies about a post only once.
+func matchAlerts(ctx context.Context, client *elastic.Client, p *Post) error {
+	query := elastic.NewBoolQuery().
+		Filter(
+			geoShapeQuery{field: "shape", shape: map[string]interface{}{
+				"type":        "point",
+				"coordinates": []float64{p.Location.Lon, p.Location.Lat},
+			}},
+			orMissing("min_face", elastic.NewRangeQuery("min_face").Lte(p.Face)),
+			orMissing("type", elastic.NewTermQuery("type", p.Type)),
+		).
+		MustNot(elastic.NewTermQuery("user", p.User)) // nobody needs to hear about their own posts.
+
+	scroll := client.Scroll(ALERT_INDEX).Query(query).Size(ALERT_BATCH_SIZE)
+	defer scroll.Clear(context.Background())
+	for {
+		pageCtx, cancel := context.WithTimeout(ctx, esTimeout)
+		searchResult, err := scroll.Do(pageCtx)
+		cancel()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var atyp SavedArea
+		for _, item := range searchResult.Each(reflect.TypeOf(atyp)) {
+			a, ok := item.(SavedArea)
+			if !ok || !a.matches(p) {
+				continue
+			}
+			alertsMatched.Add(1)
+			if err := addNotification(ctx, client, &a, p); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Function that saves a new area of a user, unless they have too many already.
+func saveArea(ctx context.Context, client *elastic.Client, a *SavedArea) error {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	n, err := client.Count(ALERT_INDEX).Query(elastic.NewTermQuery("user", a.User)).Do(ctx)
+	if err != nil {
+		return err
+	}
+	if n >= MAX_SAVED_AREAS {
+		return badRequest("too_many_areas", fmt.Sprintf("You cannot save more than %d areas", MAX_SAVED_AREAS), nil)
+	}
+
+	a.Id = uuid.New()
+	a.Created = time.Now()
+	_, err = client.Index().
+		Index(ALERT_INDEX).
+		Type(ALERT_TYPE).
+		Id(a.Id).
+		BodyJson(a).
+		Refresh("wait_for").
+		Do(ctx)
+	if elastic.IsStatusCode(err, http.StatusBadRequest) {
+		// ES checks what we cannot cheaply, such as polygons that cross themselves.
+		return badRequest("invalid_area", "The area is not a valid shape", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Concurrent saves all pass the count above. Only the MAX_SAVED_AREAS oldest areas are kept, the
+	// others are deleted again.
+	searchResult, err := client.Search().
+		Index(ALERT_INDEX).
+		Query(elastic.NewTermQuery("user", a.User)).
+		SortBy(elastic.NewFieldSort("created").Asc(), elastic.NewFieldSort("id").Asc()).
+		FetchSource(false).
+		Size(MAX_SAVED_AREAS).
+		Do(ctx)
+	if err != nil {
+		return err
+	}
+	for _, hit := range searchResult.Hits.Hits {
+		if hit.Id == a.Id {
+			a.Shape = nil
+			fmt.Printf("Area is saved to index: %s\n", a.Name)
+			return nil
+		}
+	}
+	if _, err := client.Delete().Index(ALERT_INDEX).Type(ALERT_TYPE).Id(a.Id).Refresh("wait_for").Do(ctx); err != nil {
+		return err
+	}
+	return badRequest("too_many_areas", fmt.Sprintf("You cannot save more than %d areas", MAX_SAVED_AREAS), nil)
+}
+
+// Function that reads the saved areas of a user, oldest first.
+func listAreas(ctx context.Context, client *elastic.Client, user string) ([]SavedArea, error) {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	searchResult, err := client.Search().
+		Index(ALERT_INDEX).
+		Query(elastic.NewTermQuery("user", user)).
+		SortBy(elastic.NewFieldSort("created").Asc()).
+		Size(MAX_SAVED_AREAS).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	areas := make([]SavedArea, 0, len(searchResult.Hits.Hits))
+	var atyp SavedArea
+	for _, item := range searchResult.Each(reflect.TypeOf(atyp)) {
+		if a, ok := item.(SavedArea); ok {
+			a.Shape = nil
+			areas = append(areas, a)
+		}
+	}
+	return areas, nil
+}
+
+// Function that deletes a saved area of user, admins may delete any.
+func deleteArea(ctx context.Context, client *elastic.Client, id, user string) error {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	res, err := client.Get().Index(ALERT_INDEX).Type(ALERT_TYPE).Id(id).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	var a SavedArea
+	if err := json.Unmarshal(*res.Source, &a); err != nil {
+		return err
+	}
+	if a.User != user && !isAdmin(user) {
+		return ErrForbidden
+	}
+
+	_, err = client.Delete().
+		Index(ALERT_INDEX).
+		Type(ALERT_TYPE).
+		Id(id).
+		Refresh("wait_for").
+		Do(ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		return err
+	}
+	fmt.Printf("Area is deleted: %s\n", id)
+	return nil
+}
+
+// Function that removes every saved area and notification of a user, e.g. when the user is deleted.
+func deleteAlerts(ctx context.Context, client *elastic.Client, username string) error {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	for _, index := range []string{ALERT_INDEX, NOTIFICATION_INDEX} {
+		_, err := client.DeleteByQuery(index).
+			Query(elastic.NewTermQuery("user", username)).
+			Refresh("true").
+			Do(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package main
+
+// This module feeds post events to offline analysis (BigTable, read by the PostDumpFlow Dataflow job).
+// handlerPost only puts an event on a bounded in-process queue, a background worker batches the events
+// and writes them to an EventSink, so a slow or failing analytics backend never delays or breaks posting.
+// Counters are published with expvar at /debug/vars on METRICS_ADDR (see main.go). On shutdown the queue
+// is flushed and closed, events published after that are dropped.
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"google.golang.org/api/option"
+)
+
+const (
+	ANALYTICS_QUEUE_SIZE     = 1000            // events waiting to be written, more are dropped.
+	ANALYTICS_BATCH_SIZE     = 100             // max events per write to the sink.
+	ANALYTICS_FLUSH_INTERVAL = 5 * time.Second // max time an event waits for its batch to fill up.
+
+	POST_CREATED = "created"
+)
+
+// Which sink to use: "bigtable", "file" (JSONL, for local runs and tests) or empty to turn analytics off.
+var (
+	analyticsSink = envString("ANALYTICS_SINK", "")
+	analyticsFile = envString("ANALYTICS_FILE", "analytics.jsonl")
+)
+
+var (
+	analyticsEnqueued = expvar.NewInt("analytics_enqueued")
+	analyticsDropped  = expvar.NewInt("analytics_dropped")
+	analyticsWritten  = expvar.NewInt("analytics_written")
+	analyticsFailed   = expvar.NewInt("analytics_failed")
+	analyticsBatches  = expvar.NewInt("analytics_batches")
+)
+
+// PostEvent is something that happened to a post.
+type PostEvent struct {
+	Id   string    `json:"id"`
+	Type string    `json:"type"`
+	Post *Post     `json:"post"`
+	Time time.Time `json:"time"`
+}
+
+// EventSink stores post events for offline analysis. Write must be safe to retry with the same events.
+type EventSink interface {
+	Write(ctx context.Context, events []PostEvent) error
+	Close() error
+}
+
+// Function that creates the sink named by kind, or returns nil if analytics is turned off.
+func newEventSink(ctx context.Context, kind string) (EventSink, error) {
+	switch kind {
+	case "":
+		return nil, nil
+	case "bigtable":
+		return NewBigTableSink(ctx, PROJECT_ID, BT_INSTANCE, BT_TABLE)
+	case "file":
+		return NewFileSink(analyticsFile)
+	default:
+		return nil, fmt.Errorf("unknown analytics sink %q", kind)
+	}
+}
+
+// BigTableSink writes one row per post, keyed by the post id.
+type BigTableSink struct {
+	client *bigtable.Client
+	table  *bigtable.Table
+}
+
+func NewBigTableSink(ctx context.Context, project, instance, table string) (*BigTableSink, error) {
+	client, err := bigtable.NewClient(ctx, project, instance, option.WithCredentialsFile(CREDENTIAL_FILE))
+	if err != nil {
+		return nil, err
+	}
+	return &BigTableSink{client: client, table: client.Open(table)}, nil
+}
+
+func (s *BigTableSink) Write(ctx context.Context, events []PostEvent) error {
+	keys := make([]string, len(events))
+	muts := make([]*bigtable.Mutation, len(events))
+	for i, e := range events {
+		keys[i] = e.Id
+		muts[i] = postMutation(e.Post, bigtable.Time(e.Time))
+	}
+
+	errs, err := s.table.ApplyBulk(ctx, keys, muts)
+	if err != nil {
+		return err
+	}
+	// Cells carry the event time, so writing the rows that did go through again is harmless.
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("failed to write row %s: %v", keys[i], err)
+		}
+	}
+	return nil
+}
+
+func (s *BigTableSink) Close() error {
+	return s.client.Close()
+}
+
+// FileSink appends events to a local JSONL file, one event per line.
+type FileSink struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{f: f}, nil
+}
+
+func (s *FileSink) Write(ctx context.Context, events []PostEvent) error {
+	var buf []byte
+	for _, e := range events {
+		js, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, js...)
+		buf = append(buf, '\n')
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.f.Write(buf); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+func (s *FileSink) Close() error {
+	return s.f.Close()
+}
+
+// AnalyticsQueue buffers events in memory and writes them to a sink in batches.
+type AnalyticsQueue struct {
+	sink   EventSink
+	events chan PostEvent
+	done   chan struct{}
+
+	mu     sync.RWMutex // held for writing to close events, and for reading to send on it.
+	closed bool
+}
+
+// The queue used by handlerPost, nil when analytics is turned off.
+var analytics *AnalyticsQueue
+
+func NewAnalyticsQueue(sink EventSink) *AnalyticsQueue {
+	q := &AnalyticsQueue{
+		sink:   sink,
+		events: make(chan PostEvent, ANALYTICS_QUEUE_SIZE),
+		done:   make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// Queue an event without blocking. It is dropped if the queue is full, analytics must never hold up
+// a request.
+func (q *AnalyticsQueue) Publish(e PostEvent) {
+	if q == nil {
+		return
+	}
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		analyticsDropped.Add(1)
+		fmt.Printf("Analytics queue is closed, dropped event for post %s.\n", e.Id)
+		return
+	}
+	select {
+	case q.events <- e:
+		analyticsEnqueued.Add(1)
+	default:
+		analyticsDropped.Add(1)
+		fmt.Printf("Analytics queue is full, dropped event for post %s.\n", e.Id)
+	}
+}
+
+// Stop accepting events, write what is left and close the sink.
+func (q *AnalyticsQueue) Close() error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.events)
+	}
+	q.mu.Unlock()
+	<-q.done
+	return q.sink.Close()
+}
+
+func (q *AnalyticsQueue) run() {
+	defer close(q.done)
+
+	ticker := time.NewTicker(ANALYTICS_FLUSH_INTERVAL)
+	defer ticker.Stop()
+
+	batch := make([]PostEvent, 0, ANALYTICS_BATCH_SIZE)
+	for {
+		select {
+		case e, ok := <-q.events:
+			if !ok {
+				q.flush(batch)
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) == ANALYTICS_BATCH_SIZE {
+				q.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			q.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// Write a batch, retrying with backoff. Events that still fail go to the outbox so they are not lost.
+func (q *AnalyticsQueue) flush(batch []PostEvent) {
+	if len(batch) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), bigtableTimeout*(STEP_RETRIES+1))
+	defer cancel()
+
+	analyticsBatches.Add(1)
+	err := runStep(ctx, "analytics", func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, bigtableTimeout)
+		defer cancel()
+		return q.sink.Write(ctx, batch)
+	})
+	if err != nil {
+		analyticsFailed.Add(int64(len(batch)))
+		fmt.Printf("Failed to write %d analytics events %v.\n", len(batch), err)
+		for _, e := range batch {
+			recordOutbox(OutboxEntry{PostId: e.Id, Action: "analytics.write", Post: e.Post, Error: err.Error()})
+		}
+		return
+	}
+	analyticsWritten.Add(int64(len(batch)))
+}
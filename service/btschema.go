@@ -0,0 +1,148 @@
+package main
+
+// This module describes how a Post is laid out in a BigTable row. The same descriptor drives the writer
+// (postMutation), the reader (decodePostRow) and the copy the export side reads, so the three cannot
+// drift apart. Column families never change; new fields get new columns and a new schema version.
+//
+// The export side's copy lives in dataflow/src/main/resources/post_schema.json, which the Dataflow job
+// reads to build its BigQuery rows and schema. btschema_test.go fails when the file differs from
+// json.MarshalIndent(postSchema, "", "  "); rerun it with -update-schema to rewrite the file.
+
+import (
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/pkg/errors"
+)
+
+// Version 1 wrote user, message, lat and lon. Version 2 adds every other Post field the post is created
+// with (id is the row key). The reaction and comment counters are left out on purpose: a row is written
+// once, when the post is created, and they change after that, so the row would only ever hold zeros.
+const POST_SCHEMA_VERSION = 2
+
+// BTColumn is one BigTable column of a post row.
+type BTColumn struct {
+	Family string `json:"family"`
+	Column string `json:"column"`
+	Field  string `json:"field"` // JSON field of Post, also the column name in BigQuery.
+	Type   string `json:"type"`  // BigQuery type: STRING, FLOAT or TIMESTAMP.
+	Since  int    `json:"since"` // first schema version that writes the column, older rows lack it.
+
+	encode func(p *Post) []byte
+	decode func(p *Post, b []byte) error
+}
+
+// BTSchema describes a whole post row.
+type BTSchema struct {
+	Version int        `json:"version"`
+	Table   string     `json:"table"`
+	RowKey  string     `json:"row_key"`
+	Columns []BTColumn `json:"columns"`
+	// Column holding the version a row was written with, rows without it are version 1.
+	VersionColumn string `json:"version_column"`
+}
+
+// Cells are UTF-8 text so the Dataflow job can read them with Bytes.toString: floats in shortest
+// decimal form, times as RFC 3339 in UTC with microseconds (what BigQuery TIMESTAMP accepts).
+const BT_TIME_FORMAT = "2006-01-02T15:04:05.000000Z07:00"
+
+var postSchema = BTSchema{
+	Version: POST_SCHEMA_VERSION,
+	Table:   BT_TABLE,
+	RowKey:  "id",
+	Columns: []BTColumn{
+		stringColumn("post", "user", "user", 1, func(p *Post) *string { return &p.User }),
+		stringColumn("post", "message", "message", 1, func(p *Post) *string { return &p.Message }),
+		floatColumn("location", "lat", "lat", 1, func(p *Post) *float64 { return &p.Location.Lat }),
+		floatColumn("location", "lon", "lon", 1, func(p *Post) *float64 { return &p.Location.Lon }),
+		stringColumn("post", "url", "url", 2, func(p *Post) *string { return &p.Url }),
+		stringColumn("post", "type", "type", 2, func(p *Post) *string { return &p.Type }),
+		floatColumn("post", "face", "face", 2, func(p *Post) *float64 { return &p.Face }),
+		stringColumn("post", "hash", "hash", 2, func(p *Post) *string { return &p.Hash }),
+		stringColumn("post", "duplicate_of", "duplicate_of", 2, func(p *Post) *string { return &p.DuplicateOf }),
+		timeColumn("post", "created", "created", 2, func(p *Post) *time.Time { return &p.Created }),
+	},
+	VersionColumn: "post:schema_version",
+}
+
+func stringColumn(family, column, field string, since int, f func(p *Post) *string) BTColumn {
+	return BTColumn{
+		Family: family, Column: column, Field: field, Type: "STRING", Since: since,
+		encode: func(p *Post) []byte { return []byte(*f(p)) },
+		decode: func(p *Post, b []byte) error {
+			*f(p) = string(b)
+			return nil
+		},
+	}
+}
+
+func floatColumn(family, column, field string, since int, f func(p *Post) *float64) BTColumn {
+	return BTColumn{
+		Family: family, Column: column, Field: field, Type: "FLOAT", Since: since,
+		encode: func(p *Post) []byte { return []byte(strconv.FormatFloat(*f(p), 'f', -1, 64)) },
+		decode: func(p *Post, b []byte) (err error) {
+			*f(p), err = strconv.ParseFloat(string(b), 64)
+			return err
+		},
+	}
+}
+
+func timeColumn(family, column, field string, since int, f func(p *Post) *time.Time) BTColumn {
+	return BTColumn{
+		Family: family, Column: column, Field: field, Type: "TIMESTAMP", Since: since,
+		encode: func(p *Post) []byte { return []byte(f(p).UTC().Format(BT_TIME_FORMAT)) },
+		decode: func(p *Post, b []byte) (err error) {
+			*f(p), err = time.Parse(time.RFC3339Nano, string(b))
+			return err
+		},
+	}
+}
+
+// Mutation that writes a post into its BigTable row.
+func postMutation(p *Post, t bigtable.Timestamp) *bigtable.Mutation {
+	mut := bigtable.NewMutation()
+	for _, c := range postSchema.Columns {
+		mut.Set(c.Family, c.Column, t, c.encode(p)) // cast to byte[] b/c BigTable stores data in byte array form.
+	}
+	mut.Set("post", "schema_version", t, []byte(strconv.Itoa(postSchema.Version)))
+	return mut
+}
+
+// Function that reads a BigTable row back into a Post, returning the post id (the row key) with it.
+// Columns missing from rows written by older schema versions are left at their zero value.
+func decodePostRow(row bigtable.Row) (string, *Post, error) {
+	// Only the latest cell of each column counts.
+	cells := make(map[string][]byte)
+	for _, items := range row {
+		for _, item := range items {
+			if _, ok := cells[item.Column]; !ok {
+				cells[item.Column] = item.Value
+			}
+		}
+	}
+
+	version := 1
+	if b, ok := cells[postSchema.VersionColumn]; ok {
+		v, err := strconv.Atoi(string(b))
+		if err != nil {
+			return "", nil, errors.Wrapf(err, "row %s: bad schema version", row.Key())
+		}
+		version = v
+	}
+	if version > postSchema.Version {
+		return "", nil, errors.Errorf("row %s: schema version %d is newer than %d", row.Key(), version, postSchema.Version)
+	}
+
+	p := &Post{}
+	for _, c := range postSchema.Columns {
+		b, ok := cells[c.Family+":"+c.Column]
+		if !ok {
+			continue
+		}
+		if err := c.decode(p, b); err != nil {
+			return "", nil, errors.Wrapf(err, "row %s: bad %s:%s", row.Key(), c.Family, c.Column)
+		}
+	}
+	return row.Key(), p, nil
+}
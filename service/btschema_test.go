@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"testing"
+)
+
+const POST_SCHEMA_FILE = "../dataflow/src/main/resources/post_schema.json"
+
+var updateSchema = flag.Bool("update-schema", false, "rewrite "+POST_SCHEMA_FILE+" from postSchema")
+
+// The Dataflow job builds its BigQuery rows from the copy of the schema, which must match postSchema.
+func TestPostSchemaFile(t *testing.T) {
+	want, err := json.MarshalIndent(postSchema, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, '\n')
+
+	if *updateSchema {
+		if err := ioutil.WriteFile(POST_SCHEMA_FILE, want, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := ioutil.ReadFile(POST_SCHEMA_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s differs from postSchema, run go test -run PostSchemaFile -update-schema to rewrite it", POST_SCHEMA_FILE)
+	}
+}
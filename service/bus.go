@@ -0,0 +1,158 @@
+package main
+
+// This module carries post events between the replicas of the service, so that a post created on one
+// instance reaches the /stream clients connected to any of them. handlerPost and handlerDeletePost publish
+// to the EventBus, which hands every event, those of this instance included, to its subscribers (the
+// StreamHub of stream.go).
+//
+// EVENT_BUS picks the implementation: empty for an in-process bus, fine for a single instance and local
+// runs, or "redis" for Redis pub/sub at REDIS_URL. Event ids of /stream are still per instance, a client
+// that resumes on another replica is sent a reset.
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"sync"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	POST_DELETED  = "deleted"
+	REDIS_CHANNEL = "social-radar:posts" // the pub/sub channel post events go through.
+)
+
+var (
+	eventBusKind = envString("EVENT_BUS", "")
+	redisUrl     = envString("REDIS_URL", "redis://localhost:6379/0")
+)
+
+var (
+	busPublished = expvar.NewInt("bus_published")
+	busReceived  = expvar.NewInt("bus_received")
+	busFailed    = expvar.NewInt("bus_failed")
+)
+
+// EventBus delivers post events to every instance of the service, this one included.
+type EventBus interface {
+	Publish(e PostEvent) error
+	// Call handle with every event published from now on. handle must not block.
+	Subscribe(handle func(PostEvent))
+	Close() error
+}
+
+// The bus of this process, set up in main.
+var eventBus EventBus = NewLocalBus()
+
+// Function that creates the bus named by kind.
+func newEventBus(kind string) (EventBus, error) {
+	switch kind {
+	case "", "local":
+		return NewLocalBus(), nil
+	case "redis":
+		return NewRedisBus(redisUrl)
+	default:
+		return nil, fmt.Errorf("unknown event bus %q", kind)
+	}
+}
+
+// LocalBus only reaches the subscribers of this process.
+type LocalBus struct {
+	mu       sync.RWMutex
+	handlers []func(PostEvent)
+}
+
+func NewLocalBus() *LocalBus {
+	return &LocalBus{}
+}
+
+func (b *LocalBus) Publish(e PostEvent) error {
+	busPublished.Add(1)
+	b.dispatch(e)
+	return nil
+}
+
+func (b *LocalBus) Subscribe(handle func(PostEvent)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handle)
+}
+
+func (b *LocalBus) Close() error {
+	return nil
+}
+
+func (b *LocalBus) dispatch(e PostEvent) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, handle := range b.handlers {
+		handle(e)
+	}
+}
+
+// RedisBus publishes events as JSON on REDIS_CHANNEL, and hands what it receives there to the
+// subscribers of this process.
+type RedisBus struct {
+	client *redis.Client
+	pubsub *redis.PubSub
+	local  *LocalBus
+}
+
+func NewRedisBus(url string) (*RedisBus, error) {
+	opt, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opt)
+	pubsub := client.Subscribe(REDIS_CHANNEL)
+	// Wait for the subscription, so that a Redis that is down fails the start rather than every post.
+	if _, err := pubsub.Receive(); err != nil {
+		pubsub.Close()
+		client.Close()
+		return nil, err
+	}
+
+	b := &RedisBus{client: client, pubsub: pubsub, local: NewLocalBus()}
+	go b.run()
+	return b, nil
+}
+
+// Publish e. Subscribers of this instance get it back through Redis like the others, or straight away
+// if Redis fails, so that at least they do not miss it.
+func (b *RedisBus) Publish(e PostEvent) error {
+	js, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := b.client.Publish(REDIS_CHANNEL, js).Err(); err != nil {
+		busFailed.Add(1)
+		b.local.dispatch(e)
+		return err
+	}
+	busPublished.Add(1)
+	return nil
+}
+
+func (b *RedisBus) Subscribe(handle func(PostEvent)) {
+	b.local.Subscribe(handle)
+}
+
+func (b *RedisBus) Close() error {
+	b.pubsub.Close()
+	return b.client.Close()
+}
+
+// Receive events until the bus is closed. The client reconnects by itself, events published while it
+// is disconnected are lost: pub/sub does not keep them.
+func (b *RedisBus) run() {
+	for msg := range b.pubsub.Channel() {
+		var e PostEvent
+		if err := json.Unmarshal([]byte(msg.Payload), &e); err != nil || e.Post == nil {
+			fmt.Printf("Ignoring invalid event on %s %v.\n", REDIS_CHANNEL, err)
+			continue
+		}
+		busReceived.Add(1)
+		b.local.dispatch(e)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// recorder is a bus subscriber that keeps the events it is handed.
+type recorder struct {
+	mu     sync.Mutex
+	events []PostEvent
+}
+
+func (r *recorder) handle(e PostEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+func (r *recorder) ids() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ids := make([]string, len(r.events))
+	for i, e := range r.events {
+		ids[i] = e.Id
+	}
+	return ids
+}
+
+func testEvent(id string) PostEvent {
+	return PostEvent{Id: id, Type: POST_CREATED, Post: &Post{Id: id}, Time: time.Now()}
+}
+
+func sameIds(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestLocalBus(t *testing.T) {
+	bus := NewLocalBus()
+	var first, second recorder
+	bus.Subscribe(first.handle)
+
+	if err := bus.Publish(testEvent("a")); err != nil {
+		t.Fatal(err)
+	}
+	bus.Subscribe(second.handle)
+	if err := bus.Publish(testEvent("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := first.ids(); !sameIds(got, []string{"a", "b"}) {
+		t.Errorf("first subscriber got %v, want [a b]", got)
+	}
+	// Subscribers only get the events published after they subscribed.
+	if got := second.ids(); !sameIds(got, []string{"b"}) {
+		t.Errorf("second subscriber got %v, want [b]", got)
+	}
+}
+
+func TestLocalBusConcurrentPublish(t *testing.T) {
+	const n = 50
+	bus := NewLocalBus()
+	var rec recorder
+	bus.Subscribe(rec.handle)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bus.Publish(testEvent("post"))
+		}()
+	}
+	wg.Wait()
+
+	if got := len(rec.ids()); got != n {
+		t.Errorf("got %d events, want %d", got, n)
+	}
+}
+
+func TestRedisBusPublishFallsBackToLocal(t *testing.T) {
+	// Nothing listens on port 1, so every publish fails.
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: 0, DialTimeout: time.Second})
+	defer client.Close()
+	bus := &RedisBus{client: client, local: NewLocalBus()}
+	var rec recorder
+	bus.Subscribe(rec.handle)
+
+	if err := bus.Publish(testEvent("a")); err == nil {
+		t.Fatal("publish without Redis succeeded")
+	}
+	if got := rec.ids(); !sameIds(got, []string{"a"}) {
+		t.Errorf("local subscriber got %v, want [a]", got)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+// This module caches the answers of /search, which mobile clients repeat for the same neighborhood over
+// and over. Entries are keyed on the center snapped to a grid of SEARCH_CACHE_PRECISION degrees (about
+// a kilometer), the range and the sort, so that nearby clients share one entry: the answer of the first
+// of them, whose center may be up to SEARCH_CACHE_PRECISION away. That is noise at the edge of a wide
+// search but not of a narrow one, so searches under SEARCH_CACHE_MIN_KM are not cached. Entries live
+// SEARCH_CACHE_TTL at most.
+//
+// New and deleted posts invalidate the searches they could show up in, and only those: the world is cut
+// in the grid cells of stream.go, every cell has a version that a post in it bumps, and the key of an
+// entry carries the versions of the cells its circle overlaps. A search overlapping more than
+// SEARCH_CACHE_MAX_CELLS cells uses the version of the "wide" tag, which every post bumps. Reaction and
+// comment counts are not invalidated, they may be SEARCH_CACHE_TTL old.
+//
+// SEARCH_CACHE picks the implementation: "memory" (the default) for a cache per instance, kept current
+// with the posts of the other instances by the event bus, "redis" for one cache at REDIS_URL shared by
+// every instance, or "off".
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/olivere/elastic"
+)
+
+const (
+	SEARCH_CACHE_PRECISION   = 0.01 // degrees the center of a search is snapped to.
+	SEARCH_CACHE_MAX_CELLS   = 64   // cells a search may overlap before it depends on every post.
+	SEARCH_CACHE_MIN_KM      = 10.0 // narrower searches go to ElasticSearch every time.
+	SEARCH_CACHE_MAX_ENTRIES = 10000
+	SEARCH_CACHE_WIDE        = "wide"
+)
+
+var (
+	searchCacheKind = envString("SEARCH_CACHE", "memory")
+	searchCacheTTL  = envDuration("SEARCH_CACHE_TTL", 30*time.Second)
+)
+
+var (
+	searchCacheHits   = expvar.NewInt("search_cache_hits")
+	searchCacheMisses = expvar.NewInt("search_cache_misses")
+	searchCacheErrors = expvar.NewInt("search_cache_errors")
+)
+
+// SearchCache stores search answers, and versions of the tags they depend on.
+type SearchCache interface {
+	// The current versions of tags, 0 for a tag that was never invalidated.
+	Versions(ctx context.Context, tags []string) ([]int64, error)
+	// Invalidate bumps the version of every tag.
+	Invalidate(ctx context.Context, tags []string) error
+	// Get returns ok false if there is no entry for key.
+	Get(ctx context.Context, key string) (val []byte, ok bool, err error)
+	Set(ctx context.Context, key string, val []byte, ttl time.Duration) error
+}
+
+// The cache of this process, set up in main. nil turns caching off.
+var searchCache SearchCache = NewMemoryCache(SEARCH_CACHE_MAX_ENTRIES)
+
+// Function that creates the cache named by kind.
+func newSearchCache(kind string) (SearchCache, error) {
+	switch kind {
+	case "off":
+		return nil, nil
+	case "", "memory":
+		return NewMemoryCache(SEARCH_CACHE_MAX_ENTRIES), nil
+	case "redis":
+		return NewRedisCache(redisUrl)
+	default:
+		return nil, fmt.Errorf("unknown search cache %q", kind)
+	}
+}
+
+type cacheEntry struct {
+	val     []byte
+	expires time.Time
+}
+
+// MemoryCache keeps up to a number of entries in this process.
+type MemoryCache struct {
+	mu       sync.Mutex
+	max      int
+	entries  map[string]cacheEntry
+	versions map[string]int64
+}
+
+func NewMemoryCache(max int) *MemoryCache {
+	return &MemoryCache{max: max, entries: make(map[string]cacheEntry), versions: make(map[string]int64)}
+}
+
+func (c *MemoryCache) Versions(ctx context.Context, tags []string) ([]int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	versions := make([]int64, len(tags))
+	for i, tag := range tags {
+		versions[i] = c.versions[tag]
+	}
+	return versions, nil
+}
+
+func (c *MemoryCache) Invalidate(ctx context.Context, tags []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, tag := range tags {
+		c.versions[tag]++
+	}
+	return nil
+}
+
+func (c *MemoryCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return nil, false, nil
+	}
+	return e.val, true, nil
+}
+
+func (c *MemoryCache) Set(ctx context.Context, key string, val []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.entries) >= c.max {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	// Still full: drop any entry, map order is random enough.
+	for k := range c.entries {
+		if len(c.entries) < c.max {
+			break
+		}
+		delete(c.entries, k)
+	}
+	c.entries[key] = cacheEntry{val: val, expires: now.Add(ttl)}
+	return nil
+}
+
+// RedisCache keeps entries in Redis, where they expire by themselves, and versions in counters that never
+// expire: there is one per grid cell at most.
+type RedisCache struct {
+	client *redis.Client
+}
+
+func NewRedisCache(url string) (*RedisCache, error) {
+	opt, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opt)
+	if err := client.Ping().Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &RedisCache{client: client}, nil
+}
+
+func (c *RedisCache) Versions(ctx context.Context, tags []string) ([]int64, error) {
+	keys := make([]string, len(tags))
+	for i, tag := range tags {
+		keys[i] = "social-radar:version:" + tag
+	}
+	vals, err := c.client.WithContext(ctx).MGet(keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]int64, len(tags))
+	for i, val := range vals {
+		if s, ok := val.(string); ok {
+			versions[i], _ = strconv.ParseInt(s, 10, 64)
+		}
+	}
+	return versions, nil
+}
+
+func (c *RedisCache) Invalidate(ctx context.Context, tags []string) error {
+	pipe := c.client.WithContext(ctx).Pipeline()
+	for _, tag := range tags {
+		pipe.Incr("social-radar:version:" + tag)
+	}
+	_, err := pipe.Exec()
+	return err
+}
+
+func (c *RedisCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	val, err := c.client.WithContext(ctx).Get("social-radar:search:" + key).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return val, true, nil
+}
+
+func (c *RedisCache) Set(ctx context.Context, key string, val []byte, ttl time.Duration) error {
+	return c.client.WithContext(ctx).Set("social-radar:search:"+key, val, ttl).Err()
+}
+
+/**
+ *  Helper functions:
+ */
+// Function that searches the posts around a location like readFromES, through the cache. The cache
+// failing only makes the search slower.
+func cachedSearch(ctx context.Context, client *elastic.Client, loc Location, ran, sort string) ([]Post, error) {
+	km, err := strconv.ParseFloat(strings.TrimSuffix(ran, "km"), 64)
+	if searchCache == nil || err != nil || km < SEARCH_CACHE_MIN_KM {
+		return readFromES(ctx, client, loc.Lat, loc.Lon, ran, sort)
+	}
+	snapped := Location{Lat: snap(loc.Lat), Lon: snap(loc.Lon)}
+
+	// The versions are read before ElasticSearch: a post saved meanwhile bumps them, and the answer,
+	// which may miss it, is stored under a key no one asks for anymore.
+	tags := searchTags(snapped, km)
+	versions, err := searchCache.Versions(ctx, tags)
+	if err != nil {
+		searchCacheErrors.Add(1)
+		fmt.Printf("Failed to read search cache versions %v.\n", err)
+		return readFromES(ctx, client, loc.Lat, loc.Lon, ran, sort)
+	}
+	key := searchKey(snapped, ran, sort, versions)
+
+	js, ok, err := searchCache.Get(ctx, key)
+	if err != nil {
+		searchCacheErrors.Add(1)
+		fmt.Printf("Failed to read search cache %v.\n", err)
+	}
+	if ok {
+		var posts []Post
+		if err := json.Unmarshal(js, &posts); err == nil {
+			searchCacheHits.Add(1)
+			return posts, nil
+		}
+	}
+	searchCacheMisses.Add(1)
+
+	posts, err := readFromES(ctx, client, loc.Lat, loc.Lon, ran, sort)
+	if err != nil {
+		return nil, err
+	}
+	if js, err := json.Marshal(posts); err == nil {
+		if err := searchCache.Set(ctx, key, js, searchCacheTTL); err != nil {
+			searchCacheErrors.Add(1)
+			fmt.Printf("Failed to write search cache %v.\n", err)
+		}
+	}
+	return posts, nil
+}
+
+// Function that drops the cached searches a new or deleted post could show up in.
+func invalidateSearch(ctx context.Context, p *Post) {
+	if searchCache == nil {
+		return
+	}
+	if err := searchCache.Invalidate(ctx, []string{cellTag(cellOf(p.Location)), SEARCH_CACHE_WIDE}); err != nil {
+		searchCacheErrors.Add(1)
+		fmt.Printf("Failed to invalidate search cache for post %s %v.\n", p.Id, err)
+	}
+}
+
+// The tags a search depends on: the cells its circle overlaps, or "wide" if there are too many. The
+// circle is widened by SEARCH_CACHE_PRECISION, since the posts of the entry come from a search that
+// may have been centered that far away.
+func searchTags(loc Location, km float64) []string {
+	cells := Area{Center: loc, Km: km + SEARCH_CACHE_PRECISION*KM_PER_DEGREE}.cells()
+	if cells == nil || len(cells) > SEARCH_CACHE_MAX_CELLS {
+		return []string{SEARCH_CACHE_WIDE}
+	}
+	tags := make([]string, len(cells))
+	for i, c := range cells {
+		tags[i] = cellTag(c)
+	}
+	return tags
+}
+
+func searchKey(loc Location, ran, sort string, versions []int64) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%.2f,%.2f/%s/%s/%v", loc.Lat, loc.Lon, ran, sort, versions)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func cellTag(c cell) string {
+	return fmt.Sprintf("%d,%d", c.lat, c.lon)
+}
+
+// Snap a coordinate to the grid of SEARCH_CACHE_PRECISION.
+func snap(f float64) float64 {
+	return math.Floor(f/SEARCH_CACHE_PRECISION+0.5) * SEARCH_CACHE_PRECISION
+}
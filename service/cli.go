@@ -0,0 +1,415 @@
+package main
+
+// This module is the admin CLI. Running the service with arguments runs a command instead of the server,
+// talking to the same ES, GCS and ML backends with the same settings (config.go) and store helpers:
+//
+//	go run *.go index create
+//	go run *.go user disable alice
+//	go run *.go post annotate 4c3b9e1a-...
+//
+// Commands form a tree like git or kubectl; "help" or -h at any level lists what is below it.
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/olivere/elastic"
+	"github.com/pkg/errors"
+)
+
+const CLI_NAME = "social-radar"
+
+// command is one node of the command tree. Leaves have run, the others have sub.
+type command struct {
+	name  string
+	args  string // arguments after the name, for the usage line.
+	short string
+	sub   []*command
+	run   func(args []string) error
+}
+
+// errUsage means the usage has already been printed, there is nothing more to report.
+var errUsage = errors.New("usage")
+
+var cli = &command{
+	name: CLI_NAME,
+	sub: []*command{
+		{name: "export", args: "[flags]", short: "Export posts as JSON, CSV or Parquet (see export.go)", run: runExport},
+		{
+			name:  "index",
+			short: "Manage the ElasticSearch indices",
+			sub: []*command{
+				{name: "status", short: "Show which index each alias points at and its mapping version", run: runIndexStatus},
+				{name: "create", args: "[index...]", short: "Create missing indices, all of them by default", run: runIndexCreate},
+				{name: "migrate", args: "[flags] [index...]", short: "Move indices to the latest mapping version (reindex, then swap the alias)", run: runIndexMigrate},
+				{name: "drop", args: "-yes <index>...", short: "Delete indices and everything in them", run: runIndexDrop},
+			},
+		},
+		{
+			name:  "user",
+			short: "Manage users",
+			sub: []*command{
+				{name: "list", short: "List all users", run: runUserList},
+				{name: "disable", args: "<username>...", short: "Stop users from logging in", run: runUserDisable("user disable", true)},
+				{name: "enable", args: "<username>...", short: "Let disabled users log in again", run: runUserDisable("user enable", false)},
+				{name: "delete", args: "-yes <username>...", short: "Delete users with their follows and saved areas, their posts are kept", run: runUserDelete},
+			},
+		},
+		{
+			name:  "post",
+			short: "Manage posts",
+			sub: []*command{
+				{name: "reindex", args: "-to <index> [flags]", short: "Copy every post into another index", run: runPostReindex},
+				{name: "annotate", args: "<post id>", short: "Run face detection on the image of a post again", run: runPostAnnotate},
+			},
+		},
+	},
+}
+
+// Entry point of the CLI, args are the command line without the program name. It returns the exit code.
+func runCLI(args []string) int {
+	err := cli.execute(CLI_NAME, args)
+	switch {
+	case err == nil:
+		return 0
+	case err == errUsage || err == flag.ErrHelp:
+		return 2
+	default:
+		fmt.Fprintf(os.Stderr, "%s: %v\n", CLI_NAME, err)
+		return 1
+	}
+}
+
+// Find the command args name under c and run it. path is the command line up to and including c.
+func (c *command) execute(path string, args []string) error {
+	if c.run != nil {
+		return c.run(args)
+	}
+
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		c.usage(path)
+		return errUsage
+	}
+	for _, s := range c.sub {
+		if s.name == args[0] {
+			return s.execute(path+" "+s.name, args[1:])
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command %q.\n\n", path+" "+args[0])
+	c.usage(path)
+	return errUsage
+}
+
+func (c *command) usage(path string) {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command>\n\nCommands:\n", path)
+	tw := tabwriter.NewWriter(os.Stderr, 0, 8, 2, ' ', 0)
+	for _, s := range c.sub {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", s.name, s.args, s.short)
+	}
+	tw.Flush()
+	if c == cli {
+		fmt.Fprintf(os.Stderr, "\nWithout a command the HTTP server is started.\n")
+	}
+}
+
+// Parse the flags of a leaf command. Flags must come before the other arguments.
+func parseFlags(flags *flag.FlagSet, args []string) ([]string, error) {
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	return flags.Args(), nil
+}
+
+// Connect to ES like the server does. esClient is set too, for helpers that use it directly.
+func connectES() (*elastic.Client, error) {
+	client, err := newESClient(ES_URL)
+	if err != nil {
+		return nil, err
+	}
+	esClient = client
+	userStore = ESUserStore{client: client}
+	return client, nil
+}
+
+// The indices named in args, or every index if there are none.
+func selectIndices(args []string) ([]esIndex, error) {
+	if len(args) == 0 {
+		return esIndices, nil
+	}
+	var indices []esIndex
+	for _, name := range args {
+		idx, err := findIndex(name)
+		if err != nil {
+			return nil, err
+		}
+		indices = append(indices, idx)
+	}
+	return indices, nil
+}
+
+func runIndexCreate(args []string) error {
+	args, err := parseFlags(flag.NewFlagSet("index create", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+	indices, err := selectIndices(args)
+	if err != nil {
+		return err
+	}
+	client, err := connectES()
+	if err != nil {
+		return err
+	}
+
+	for _, idx := range indices {
+		created, err := createIndex(context.Background(), client, idx)
+		if err != nil {
+			return err
+		}
+		if !created {
+			fmt.Printf("Index already exists: %s\n", idx.Name)
+		}
+	}
+	return nil
+}
+
+func runIndexStatus(args []string) error {
+	if _, err := parseFlags(flag.NewFlagSet("index status", flag.ContinueOnError), args); err != nil {
+		return err
+	}
+	client, err := connectES()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ALIAS\tINDEX\tVERSION\tEXPECTED")
+	for _, idx := range esIndices {
+		live, version, err := liveIndex(context.Background(), client, idx.Name)
+		if err != nil {
+			return err
+		}
+		if live == "" {
+			fmt.Fprintf(tw, "%s\t-\t-\t%d\n", idx.Name, idx.latest().Version)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\n", idx.Name, live, version, idx.latest().Version)
+	}
+	return tw.Flush()
+}
+
+func runIndexMigrate(args []string) error {
+	flags := flag.NewFlagSet("index migrate", flag.ContinueOnError)
+	timeout := flags.Duration("timeout", time.Hour, "how long to wait for ES to copy each index")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	indices, err := selectIndices(args)
+	if err != nil {
+		return err
+	}
+	client, err := connectES()
+	if err != nil {
+		return err
+	}
+
+	for _, idx := range indices {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		err := migrateIndex(ctx, client, idx)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to migrate %s: %v", idx.Name, err)
+		}
+	}
+	return nil
+}
+
+func runIndexDrop(args []string) error {
+	flags := flag.NewFlagSet("index drop", flag.ContinueOnError)
+	yes := flags.Bool("yes", false, "really delete the indices")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("index drop needs the names of the indices")
+	}
+	if !*yes {
+		return fmt.Errorf("this deletes every document in %v, add -yes to go ahead", args)
+	}
+	client, err := connectES()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range args {
+		if err := dropIndex(context.Background(), client, name); err != nil {
+			return fmt.Errorf("failed to drop %s: %v", name, err)
+		}
+		fmt.Printf("Index is dropped: %s\n", name)
+	}
+	return nil
+}
+
+func runUserList(args []string) error {
+	if _, err := parseFlags(flag.NewFlagSet("user list", flag.ContinueOnError), args); err != nil {
+		return err
+	}
+	client, err := connectES()
+	if err != nil {
+		return err
+	}
+
+	users, err := listUsers(context.Background(), client)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "USERNAME\tAGE\tGENDER\tSTATUS")
+	for _, u := range users {
+		status := "active"
+		if u.Disabled {
+			status = "disabled"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", u.Username, u.Age, u.Gender, status)
+	}
+	return tw.Flush()
+}
+
+func runUserDisable(name string, disabled bool) func(args []string) error {
+	return func(args []string) error {
+		args, err := parseFlags(flag.NewFlagSet(name, flag.ContinueOnError), args)
+		if err != nil {
+			return err
+		}
+		if len(args) == 0 {
+			return fmt.Errorf("missing username")
+		}
+		if _, err := connectES(); err != nil {
+			return err
+		}
+
+		for _, username := range args {
+			if err := setUserDisabled(context.Background(), userStore, username, disabled); err != nil {
+				return fmt.Errorf("user %s: %v", username, err)
+			}
+			if disabled {
+				fmt.Printf("User is disabled: %s\n", username)
+			} else {
+				fmt.Printf("User is enabled: %s\n", username)
+			}
+		}
+		return nil
+	}
+}
+
+func runUserDelete(args []string) error {
+	flags := flag.NewFlagSet("user delete", flag.ContinueOnError)
+	yes := flags.Bool("yes", false, "really delete the users")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("missing username")
+	}
+	if !*yes {
+		return fmt.Errorf("this deletes the accounts of %v, add -yes to go ahead", args)
+	}
+	client, err := connectES()
+	if err != nil {
+		return err
+	}
+
+	for _, username := range args {
+		if err := deleteUser(context.Background(), client, username); err != nil {
+			return fmt.Errorf("user %s: %v", username, err)
+		}
+	}
+	return nil
+}
+
+func runPostReindex(args []string) error {
+	flags := flag.NewFlagSet("post reindex", flag.ContinueOnError)
+	from := flags.String("from", POST_INDEX, "index to copy the posts from")
+	to := flags.String("to", "", "index to copy the posts into, created with the latest post mapping if missing")
+	timeout := flags.Duration("timeout", time.Hour, "how long to wait for ES to finish")
+	if _, err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if *to == "" || *to == *from {
+		return fmt.Errorf("post reindex needs a -to index other than %s", *from)
+	}
+	idx, _ := findIndex(POST_INDEX)
+	client, err := connectES()
+	if err != nil {
+		return err
+	}
+
+	if _, err := createVersionedIndex(context.Background(), client, *to, idx.latest()); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	n, err := reindex(ctx, client, *from, *to, reindexOptions{Type: idx.latest().Type})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Copied %d posts from %s to %s.\n", n, *from, *to)
+	return nil
+}
+
+func runPostAnnotate(args []string) error {
+	args, err := parseFlags(flag.NewFlagSet("post annotate", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("post annotate needs exactly one post id")
+	}
+	client, err := connectES()
+	if err != nil {
+		return err
+	}
+
+	score, err := reannotatePost(context.Background(), client, args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Post %s has a face score of %f.\n", args[0], score)
+	return nil
+}
+
+// Function that runs the image of a stored post through the ML model again and saves the new score.
+func reannotatePost(ctx context.Context, client *elastic.Client, id string) (float64, error) {
+	p, err := readPostFromES(ctx, client, id)
+	if err != nil {
+		return 0, err
+	}
+	if p.Type != "image" {
+		return 0, fmt.Errorf("post %s is of type %s, only images can be annotated", id, p.Type)
+	}
+
+	// Images are stored in GCS under the post id.
+	buf, err := readFromGCS(ctx, BUCKET_NAME, id)
+	if err != nil {
+		return 0, err
+	}
+	// ML Engine only supports jpeg, and an image post may be a gif or png. The stored object has no
+	// name to go by, so look at its content.
+	if t := http.DetectContentType(buf); t != "image/jpeg" {
+		return 0, fmt.Errorf("image of post %s is %s, only jpeg can be annotated", id, t)
+	}
+	score, err := annotate(ctx, bytes.NewReader(buf))
+	if err != nil {
+		return 0, err
+	}
+	return score, updatePostInES(ctx, client, id, map[string]interface{}{"face": score})
+}
@@ -0,0 +1,399 @@
+package main
+
+// This module lets users discuss posts:
+//
+//	POST   /api/v1/posts/{id}/comments             comment on a post, or reply to a comment with parent_id
+//	GET    /api/v1/posts/{id}/comments             comments of a post, oldest first
+//	PATCH  /api/v1/posts/{id}/comments/{comment}   change the message of your comment
+//	DELETE /api/v1/posts/{id}/comments/{comment}   delete your comment (admins may delete any)
+//
+// Threads are built by clients from parent_id, a comment without one answers the post itself. The list
+// takes ?parent_id= to only get the replies to one comment, and pages like the feed (?limit=, ?cursor=).
+// A deleted comment stays in the list with deleted set and no message, so its replies keep their place.
+// The post keeps the number of comments that are not deleted, updated like its reaction counters.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/olivere/elastic"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	COMMENT_INDEX = "comment"
+	COMMENT_TYPE  = "comment"
+)
+
+// Comment is one comment on a post.
+type Comment struct {
+	Id       string     `json:"id"`
+	PostId   string     `json:"post_id"`
+	ParentId string     `json:"parent_id,omitempty"` // the comment this one replies to.
+	User     string     `json:"user"`
+	Message  string     `json:"message"`
+	Created  time.Time  `json:"created"`
+	Edited   *time.Time `json:"edited,omitempty"`
+	Deleted  bool       `json:"deleted,omitempty"`
+}
+
+// CommentRequest is the body of POST and PATCH requests, PATCH ignores parent_id.
+type CommentRequest struct {
+	ParentId string `json:"parent_id"`
+	Message  string `json:"message"`
+}
+
+// CommentPage is one page of the comments of a post.
+type CommentPage struct {
+	Comments   []Comment `json:"comments"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// Adds delta to the comment counter of a post.
+const COMMENT_COUNT_SCRIPT = `
+def n = ctx._source.comment_count == null ? 0 : ctx._source.comment_count;
+ctx._source.comment_count = Math.max(0, n + params.delta);
+`
+
+// Marks a comment deleted, or does nothing if it already is so the post counts it only once.
+const COMMENT_DELETE_SCRIPT = `
+if (ctx._source.deleted == true) {
+	ctx.op = 'none';
+} else {
+	ctx._source.deleted = true;
+	ctx._source.message = '';
+}
+`
+
+// Handler for GET and POST on /posts/{id}/comments.
+func handlerComments(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
+	w.Header().Set("Access-Control-Allow-Methods", "GET,POST")
+
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	postId := mux.Vars(r)["id"]
+	if r.Method == "POST" {
+		fmt.Printf("Received one comment on post %s\n", postId)
+
+		var req CommentRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, badRequest("invalid_json", "Failed to parse JSON input from client", err))
+			return
+		}
+		var v ValidationError
+		if req.Message == "" {
+			v.Add("message", "is required")
+		}
+		v.Message("message", req.Message)
+		if err := v.Err(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		c, err := addComment(r.Context(), esClient, postId, req.ParentId, getUsername(r), req.Message)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		js, err := json.Marshal(c)
+		if err != nil {
+			writeError(w, r, internalError("Failed to parse comment into JSON format", err))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write(js)
+		return
+	}
+
+	query := r.URL.Query()
+	var v ValidationError
+	limit := v.Limit("limit", query.Get("limit"))
+	after := v.Cursor("cursor", query.Get("cursor"))
+	if err := v.Err(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if _, err := readPostFromES(r.Context(), esClient, postId); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	comments, next, err := listComments(r.Context(), esClient, postId, query.Get("parent_id"), after, limit)
+	if err != nil {
+		writeError(w, r, internalError("Failed to read comments from ElasticSearch", err))
+		return
+	}
+
+	page := CommentPage{Comments: comments}
+	if next != nil {
+		page.NextCursor = encodeCursor(next)
+	}
+	js, err := json.Marshal(page)
+	if err != nil {
+		writeError(w, r, internalError("Failed to parse comments into JSON format", err))
+		return
+	}
+	w.Write(js)
+}
+
+// Handler for PATCH and DELETE on /posts/{id}/comments/{comment}. PATCH answers with the comment, DELETE
+// with 204.
+func handlerComment(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
+	w.Header().Set("Access-Control-Allow-Methods", "PATCH,DELETE")
+
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	vars := mux.Vars(r)
+	user := getUsername(r)
+	c, err := getComment(r.Context(), esClient, vars["comment"])
+	if err == nil && (c.PostId != vars["id"] || c.Deleted) {
+		err = ErrNotFound
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if r.Method == "DELETE" {
+		if c.User != user && !isAdmin(user) {
+			writeError(w, r, ErrForbidden)
+			return
+		}
+		if err := deleteComment(r.Context(), esClient, c); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Only the author may put words in their own mouth.
+	if c.User != user {
+		writeError(w, r, ErrForbidden)
+		return
+	}
+	var req CommentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, badRequest("invalid_json", "Failed to parse JSON input from client", err))
+		return
+	}
+	var v ValidationError
+	if req.Message == "" {
+		v.Add("message", "is required")
+	}
+	v.Message("message", req.Message)
+	if err := v.Err(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	edited := time.Now()
+	if err := updateComment(r.Context(), esClient, c.Id, map[string]interface{}{"message": req.Message, "edited": edited}); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	c.Message, c.Edited = req.Message, &edited
+	js, err := json.Marshal(c)
+	if err != nil {
+		writeError(w, r, internalError("Failed to parse comment into JSON format", err))
+		return
+	}
+	w.Write(js)
+}
+
+/**
+ *  Helper functions:
+ */
+// Function that saves a comment of user on a post, replying to the comment parentId if it is not empty,
+// and counts it.
+func addComment(ctx context.Context, client *elastic.Client, postId, parentId, user, message string) (*Comment, error) {
+	if _, err := readPostFromES(ctx, client, postId); err != nil {
+		return nil, err
+	}
+	if parentId != "" {
+		parent, err := getComment(ctx, client, parentId)
+		if err != nil && err != ErrNotFound {
+			return nil, err
+		}
+		if err == ErrNotFound || parent.PostId != postId || parent.Deleted {
+			return nil, badRequest("invalid_parent", "The comment to reply to is not on this post", nil)
+		}
+	}
+
+	c := &Comment{
+		Id:       uuid.New(),
+		PostId:   postId,
+		ParentId: parentId,
+		User:     user,
+		Message:  message,
+		Created:  time.Now(),
+	}
+	indexCtx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+	_, err := client.Index().
+		Index(COMMENT_INDEX).
+		Type(COMMENT_TYPE).
+		Id(c.Id).
+		BodyJson(c).
+		Refresh("wait_for").
+		Do(indexCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	countComment(ctx, client, postId, 1)
+	fmt.Printf("Comment is saved to index: %s\n", c.Id)
+	return c, nil
+}
+
+// Function that reads one comment, ErrNotFound if there is none with this id.
+func getComment(ctx context.Context, client *elastic.Client, id string) (*Comment, error) {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	res, err := client.Get().
+		Index(COMMENT_INDEX).
+		Type(COMMENT_TYPE).
+		Id(id).
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var c Comment
+	if err := json.Unmarshal(*res.Source, &c); err != nil {
+		return nil, errors.Wrapf(err, "comment %s", id)
+	}
+	return &c, nil
+}
+
+// Function that changes some fields of a stored comment.
+func updateComment(ctx context.Context, client *elastic.Client, id string, fields map[string]interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	_, err := client.Update().
+		Index(COMMENT_INDEX).
+		Type(COMMENT_TYPE).
+		Id(id).
+		Doc(fields).
+		Refresh("wait_for").
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Function that deletes a comment. Only its message goes, so the replies to it still have a parent.
+func deleteComment(ctx context.Context, client *elastic.Client, c *Comment) error {
+	updateCtx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	res, err := client.Update().
+		Index(COMMENT_INDEX).
+		Type(COMMENT_TYPE).
+		Id(c.Id).
+		Script(elastic.NewScript(COMMENT_DELETE_SCRIPT)).
+		Refresh("wait_for").
+		Do(updateCtx)
+	if elastic.IsNotFound(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if res.Result == "noop" {
+		return nil // deleted at the same time by another request, which uncounted it.
+	}
+
+	countComment(ctx, client, c.PostId, -1)
+	fmt.Printf("Comment is deleted: %s\n", c.Id)
+	return nil
+}
+
+// Add delta to the comment counter of a post.
+func countComment(ctx context.Context, client *elastic.Client, postId string, delta int) {
+	script := elastic.NewScript(COMMENT_COUNT_SCRIPT).Params(map[string]interface{}{"delta": delta})
+	updatePostCounter(ctx, client, postId, script, "comments.recount")
+}
+
+// Function that sets the comment counter of a post from the comment index.
+func recountComments(ctx context.Context, client *elastic.Client, postId string) error {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	n, err := client.Count(COMMENT_INDEX).
+		Query(elastic.NewBoolQuery().
+			Filter(elastic.NewTermQuery("post_id", postId)).
+			MustNot(elastic.NewTermQuery("deleted", true))).
+		Do(ctx)
+	if err != nil {
+		return err
+	}
+	return updatePostInES(ctx, client, postId, map[string]interface{}{"comment_count": n})
+}
+
+// Function that removes every comment on a post, when the post is deleted.
+func deleteComments(ctx context.Context, client *elastic.Client, postId string) error {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	_, err := client.DeleteByQuery(COMMENT_INDEX).
+		Query(elastic.NewTermQuery("post_id", postId)).
+		Refresh("true").
+		Do(ctx)
+	return err
+}
+
+// Function that reads one page of the comments of a post, oldest first, optionally only the replies to
+// the comment parentId. It returns the sort values of the last comment when there may be another page.
+func listComments(ctx context.Context, client *elastic.Client, postId, parentId string, after []interface{}, limit int) ([]Comment, []interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	query := elastic.NewBoolQuery().Filter(elastic.NewTermQuery("post_id", postId))
+	if parentId != "" {
+		query = query.Filter(elastic.NewTermQuery("parent_id", parentId))
+	}
+	search := client.Search().
+		Index(COMMENT_INDEX).
+		Query(query).
+		SortBy(elastic.NewFieldSort("created").Asc(), elastic.NewFieldSort("id").Asc()).
+		Size(limit)
+	if after != nil {
+		search = search.SearchAfter(after...)
+	}
+	searchResult, err := search.Do(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	comments := make([]Comment, 0, len(searchResult.Hits.Hits))
+	for _, hit := range searchResult.Hits.Hits {
+		var c Comment
+		if err := json.Unmarshal(*hit.Source, &c); err != nil {
+			return nil, nil, errors.Wrapf(err, "comment %s", hit.Id)
+		}
+		comments = append(comments, c)
+	}
+	return comments, nextPage(searchResult, limit), nil
+}
@@ -0,0 +1,56 @@
+package main
+
+// This module holds settings that differ between deployments. Each one has a default that works for the
+// production setup and can be overridden with an environment variable, e.g. an ENV line in the Dockerfile.
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// How long each backend may take to answer one call, e.g. ES_TIMEOUT=3s.
+var (
+	esTimeout       = envDuration("ES_TIMEOUT", 5*time.Second)
+	gcsTimeout      = envDuration("GCS_TIMEOUT", 30*time.Second)
+	mlTimeout       = envDuration("ML_TIMEOUT", 10*time.Second)
+	bigtableTimeout = envDuration("BIGTABLE_TIMEOUT", 5*time.Second)
+)
+
+// Read a string from the environment, falling back to def if it is unset.
+func envString(name, def string) string {
+	if val := os.Getenv(name); val != "" {
+		return val
+	}
+	return def
+}
+
+// Read a duration such as "500ms" or "2s" from the environment, falling back to def if it is unset
+// or malformed.
+func envDuration(name string, def time.Duration) time.Duration {
+	val := os.Getenv(name)
+	if val == "" {
+		return def
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		fmt.Printf("Ignoring invalid %s=%q, using %v.\n", name, val, def)
+		return def
+	}
+	return d
+}
+
+// Read an integer from the environment, falling back to def if it is unset or malformed.
+func envInt(name string, def int) int {
+	val := os.Getenv(name)
+	if val == "" {
+		return def
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		fmt.Printf("Ignoring invalid %s=%q, using %d.\n", name, val, def)
+		return def
+	}
+	return n
+}
@@ -0,0 +1,156 @@
+package main
+
+// This module is the error model of the service. The store and auth helpers return the sentinel errors
+// below (possibly wrapped with github.com/pkg/errors), handlers build an HTTPError for failures of their
+// own, and writeError turns all of them into the same JSON envelope:
+//
+//	{"error": {"code": "user_exists", "message": "User already exists", "request_id": "..."}}
+//
+// Clients should branch on code, message is for humans and may change.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+)
+
+// Sentinel errors returned by the store and auth layers.
+var (
+	ErrNotFound         = errors.New("not found")
+	ErrUserExists       = errors.New("user already exists")
+	ErrWrongCredentials = errors.New("wrong username or password")
+	ErrUserDisabled     = errors.New("user is disabled")
+	ErrUnauthorized     = errors.New("missing or invalid token")
+	ErrForbidden        = errors.New("forbidden")
+	ErrDuplicateImage   = errors.New("image was already posted")
+	ErrRateLimited      = errors.New("too many requests")
+	ErrLockedOut        = errors.New("too many failed logins")
+)
+
+// How each sentinel error is reported to clients.
+var sentinelErrors = map[error]HTTPError{
+	ErrNotFound:         {Status: http.StatusNotFound, Code: "not_found", Message: "Not found"},
+	ErrUserExists:       {Status: http.StatusConflict, Code: "user_exists", Message: "User already exists"},
+	ErrWrongCredentials: {Status: http.StatusUnauthorized, Code: "wrong_credentials", Message: "Wrong username or password"},
+	ErrUserDisabled:     {Status: http.StatusForbidden, Code: "user_disabled", Message: "This account has been disabled"},
+	ErrUnauthorized:     {Status: http.StatusUnauthorized, Code: "unauthorized", Message: "Missing or invalid token"},
+	ErrForbidden:        {Status: http.StatusForbidden, Code: "forbidden", Message: "You are not allowed to do this"},
+	ErrDuplicateImage:   {Status: http.StatusConflict, Code: "duplicate_image", Message: "You already posted this image"},
+	ErrRateLimited:      {Status: http.StatusTooManyRequests, Code: "rate_limited", Message: "Too many requests, retry later"},
+	ErrLockedOut:        {Status: http.StatusTooManyRequests, Code: "locked_out", Message: "Too many failed logins, retry later"},
+}
+
+// HTTPError is a failure that is reported to the client as is.
+type HTTPError struct {
+	Status  int
+	Code    string
+	Message string
+	Err     error // underlying cause, logged but never sent to the client.
+}
+
+func (e *HTTPError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+// A request the client has to fix before retrying.
+func badRequest(code, message string, err error) error {
+	return &HTTPError{Status: http.StatusBadRequest, Code: code, Message: message, Err: err}
+}
+
+// A failure of the service or one of its backends.
+func internalError(message string, err error) error {
+	return &HTTPError{Status: http.StatusInternalServerError, Code: "internal_error", Message: message, Err: err}
+}
+
+// ErrorBody is the "error" object of a JSON error response.
+type ErrorBody struct {
+	Code      string       `json:"code"`
+	Message   string       `json:"message"`
+	RequestId string       `json:"request_id,omitempty"`
+	Fields    []FieldError `json:"fields,omitempty"`
+}
+
+// Send err to the client as a JSON error envelope and log it with the request id.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status, body := errorBody(r, err)
+	js, _ := json.Marshal(struct {
+		Error ErrorBody `json:"error"`
+	}{body})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+// Work out the status and the "error" object to report err with, and log it with the request id. Also
+// used by connections that report errors without an HTTP response of their own, such as /stream.
+func errorBody(r *http.Request, err error) (int, ErrorBody) {
+	e := HTTPError{Status: http.StatusInternalServerError, Code: "internal_error", Message: "Internal server error"}
+	var fields []FieldError
+
+	switch cause := errors.Cause(err).(type) {
+	case *ValidationError:
+		e = HTTPError{Status: http.StatusBadRequest, Code: "invalid_request", Message: "Invalid request"}
+		fields = cause.Fields
+	case *HTTPError:
+		e = *cause
+	default:
+		if s, ok := sentinelErrors[cause]; ok {
+			e = s
+		}
+	}
+	if isTimeout(err) {
+		e = HTTPError{Status: http.StatusGatewayTimeout, Code: "timeout", Message: "A backend did not respond in time"}
+	}
+
+	body := ErrorBody{
+		Code:      e.Code,
+		Message:   e.Message,
+		RequestId: requestId(r),
+		Fields:    fields,
+	}
+	fmt.Printf("[%s] %d %s: %v.\n", body.RequestId, e.Status, e.Code, err)
+	return e.Status, body
+}
+
+// Check if err, or the backend failure an HTTPError wraps, is a deadline being exceeded. Both
+// context.DeadlineExceeded and the net errors wrapping it report themselves through Timeout().
+func isTimeout(err error) bool {
+	cause := errors.Cause(err)
+	if h, ok := cause.(*HTTPError); ok && h.Err != nil {
+		cause = errors.Cause(h.Err)
+	}
+	t, ok := cause.(interface {
+		Timeout() bool
+	})
+	return ok && t.Timeout()
+}
+
+type contextKey string
+
+const requestIdKey contextKey = "request_id"
+
+// Middleware that tags every request with an id, taken from the X-Request-ID header when the client or
+// a proxy already set one. The id is echoed back in the response header and in error bodies.
+func withRequestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" {
+			id = uuid.New()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIdKey, id)))
+	})
+}
+
+// Get the id withRequestId assigned to a request.
+func requestId(r *http.Request) string {
+	id, _ := r.Context().Value(requestIdKey).(string)
+	return id
+}
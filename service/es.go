@@ -0,0 +1,68 @@
+package main
+
+// This module owns the connection to ElasticSearch. One client is built at startup and passed to every
+// helper that talks to ES, so requests reuse its connections, health checks and retry policy instead of
+// paying for a new handshake each time.
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/olivere/elastic"
+)
+
+const (
+	ES_SNIFF                = false                  // ES runs on a single GCE VM; sniffing would return its internal address.
+	ES_HEALTHCHECK_INTERVAL = 30 * time.Second       // how often the client checks the node is alive.
+	ES_STARTUP_TIMEOUT      = 10 * time.Second       // how long to wait for ES when the service starts.
+	ES_RETRY_INITIAL        = 100 * time.Millisecond // first wait before retrying a failed request.
+	ES_RETRY_MAX            = 5 * time.Second        // longest wait between retries.
+	ES_READY_TIMEOUT        = 2 * time.Second        // max time the readiness check waits for cluster health.
+)
+
+// The client shared by all handlers, set up in main.
+var esClient *elastic.Client
+
+// Function that creates a long-lived ES client. It fails if ES cannot be reached within ES_STARTUP_TIMEOUT.
+func newESClient(url string) (*elastic.Client, error) {
+	return elastic.NewClient(
+		elastic.SetURL(url),
+		elastic.SetSniff(ES_SNIFF),
+		elastic.SetHealthcheck(true),
+		elastic.SetHealthcheckInterval(ES_HEALTHCHECK_INTERVAL),
+		elastic.SetHealthcheckTimeoutStartup(ES_STARTUP_TIMEOUT),
+		// Requests that fail in transport (connection refused or reset, a timeout) are retried with
+		// exponential backoff before they fail. The retrier never sees an answer, so a 502, 503 or 429
+		// from ES fails the request right away; post creation retries those itself (see runStep).
+		elastic.SetRetrier(elastic.NewBackoffRetrier(elastic.NewExponentialBackoff(ES_RETRY_INITIAL, ES_RETRY_MAX))),
+	)
+}
+
+// Handler for the App Engine liveness check: the process is up and serving.
+func handlerLiveness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+// Handler for the App Engine readiness check: the instance only gets traffic while ES is reachable and
+// the cluster is not red.
+func handlerReadiness(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), ES_READY_TIMEOUT)
+	defer cancel()
+
+	health, err := esClient.ClusterHealth().Do(ctx)
+	if err != nil {
+		writeError(w, r, &HTTPError{Status: http.StatusServiceUnavailable, Code: "not_ready", Message: "ElasticSearch is unreachable", Err: err})
+		return
+	}
+	if health.Status == "red" {
+		writeError(w, r, &HTTPError{Status: http.StatusServiceUnavailable, Code: "not_ready", Message: "ElasticSearch cluster is red"})
+		return
+	}
+
+	js, _ := json.Marshal(map[string]string{"status": "ok", "elasticsearch": health.Status})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,345 @@
+package main
+
+// This module is the "export" command: it dumps posts from the post index (or the BigTable analytics
+// table) into newline-delimited JSON, CSV or Parquet files that can be loaded into BigQuery or DuckDB.
+// Next to the data it writes a BigQuery schema file, e.g.
+//
+//	go run *.go export -format parquet -out posts.parquet -state export.state
+//	bq load --source_format=PARQUET post_analysis.posts posts.parquet
+//
+// With -state, each run only exports the posts created since the previous run. A post is stamped with
+// its created time before it is saved, and may show up in the index up to the time saving takes later,
+// so a run stops at EXPORT_GRACE (or -grace) before it started, and that is what the state file keeps:
+// the next run picks up from there, and a slow post is exported by the run after its grace has passed
+// instead of being skipped.
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/olivere/elastic"
+	"github.com/pkg/errors"
+	"github.com/xitongsys/parquet-go/writer"
+	"google.golang.org/api/option"
+)
+
+const (
+	EXPORT_PAGE_SIZE = 500              // posts fetched from ES per scroll page.
+	EXPORT_GRACE     = 10 * time.Minute // longer than saving a post may take, see runSaga.
+)
+
+// ExportRecord is one exported post. The parquet tags declare the Parquet schema, exportSchema the
+// matching BigQuery one.
+type ExportRecord struct {
+	Id          string  `json:"id" parquet:"name=id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	User        string  `json:"user" parquet:"name=user, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Message     string  `json:"message" parquet:"name=message, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Lat         float64 `json:"lat" parquet:"name=lat, type=DOUBLE"`
+	Lon         float64 `json:"lon" parquet:"name=lon, type=DOUBLE"`
+	Url         string  `json:"url" parquet:"name=url, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Type        string  `json:"type" parquet:"name=type, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Face        float64 `json:"face" parquet:"name=face, type=DOUBLE"`
+	Hash        string  `json:"hash" parquet:"name=hash, type=BYTE_ARRAY, convertedtype=UTF8"`
+	DuplicateOf string  `json:"duplicate_of" parquet:"name=duplicate_of, type=BYTE_ARRAY, convertedtype=UTF8"`
+	// Posts from before created was recorded leave it empty, which BigQuery loads as null.
+	Created     string `json:"created,omitempty"`                                                                             // RFC 3339, for JSON and CSV.
+	CreatedTime *int64 `json:"-" parquet:"name=created, type=INT64, convertedtype=TIMESTAMP_MICROS, repetitiontype=OPTIONAL"` // same instant, for Parquet.
+}
+
+// ExportField is one column of the BigQuery schema file.
+type ExportField struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Mode string `json:"mode"`
+}
+
+var exportSchema = []ExportField{
+	{"id", "STRING", "REQUIRED"},
+	{"user", "STRING", "NULLABLE"},
+	{"message", "STRING", "NULLABLE"},
+	{"lat", "FLOAT", "NULLABLE"},
+	{"lon", "FLOAT", "NULLABLE"},
+	{"url", "STRING", "NULLABLE"},
+	{"type", "STRING", "NULLABLE"},
+	{"face", "FLOAT", "NULLABLE"},
+	{"hash", "STRING", "NULLABLE"},
+	{"duplicate_of", "STRING", "NULLABLE"},
+	{"created", "TIMESTAMP", "NULLABLE"},
+}
+
+func newExportRecord(id string, p *Post) ExportRecord {
+	rec := ExportRecord{
+		Id:          id,
+		User:        p.User,
+		Message:     p.Message,
+		Lat:         p.Location.Lat,
+		Lon:         p.Location.Lon,
+		Url:         p.Url,
+		Type:        p.Type,
+		Face:        p.Face,
+		Hash:        p.Hash,
+		DuplicateOf: p.DuplicateOf,
+	}
+	if !p.Created.IsZero() {
+		micros := p.Created.UnixNano() / int64(time.Microsecond)
+		rec.Created = p.Created.UTC().Format(BT_TIME_FORMAT)
+		rec.CreatedTime = &micros
+	}
+	return rec
+}
+
+// recordWriter writes exported posts in one file format.
+type recordWriter interface {
+	Write(rec ExportRecord) error
+	Close() error
+}
+
+type jsonWriter struct {
+	enc *json.Encoder
+}
+
+func (w *jsonWriter) Write(rec ExportRecord) error { return w.enc.Encode(rec) }
+
+func (w *jsonWriter) Close() error { return nil }
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func newCSVWriter(out io.Writer) (*csvWriter, error) {
+	w := csv.NewWriter(out)
+	header := make([]string, len(exportSchema))
+	for i, f := range exportSchema {
+		header[i] = f.Name
+	}
+	return &csvWriter{w: w}, w.Write(header)
+}
+
+func (w *csvWriter) Write(rec ExportRecord) error {
+	float := func(f float64) string { return strconv.FormatFloat(f, 'f', -1, 64) }
+	return w.w.Write([]string{
+		rec.Id, rec.User, rec.Message, float(rec.Lat), float(rec.Lon), rec.Url, rec.Type,
+		float(rec.Face), rec.Hash, rec.DuplicateOf, rec.Created,
+	})
+}
+
+func (w *csvWriter) Close() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+type parquetWriter struct {
+	pw *writer.ParquetWriter
+}
+
+func newParquetWriter(out io.Writer) (*parquetWriter, error) {
+	pw, err := writer.NewParquetWriterFromWriter(out, new(ExportRecord), 4)
+	if err != nil {
+		return nil, err
+	}
+	return &parquetWriter{pw: pw}, nil
+}
+
+func (w *parquetWriter) Write(rec ExportRecord) error { return w.pw.Write(rec) }
+func (w *parquetWriter) Close() error                 { return w.pw.WriteStop() }
+
+func newRecordWriter(format string, out io.Writer) (recordWriter, error) {
+	switch format {
+	case "json":
+		return &jsonWriter{enc: json.NewEncoder(out)}, nil
+	case "csv":
+		return newCSVWriter(out)
+	case "parquet":
+		return newParquetWriter(out)
+	default:
+		return nil, fmt.Errorf("unknown format %q, use json, csv or parquet", format)
+	}
+}
+
+// Entry point of the export command, args are the command line after "export".
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	source := flags.String("source", "es", "where to read posts from: es or bigtable")
+	format := flags.String("format", "json", "output format: json (newline-delimited), csv or parquet")
+	out := flags.String("out", "", "output file, standard output if empty (not allowed for parquet)")
+	schema := flags.String("schema", "", "where to write the BigQuery schema, defaults to <out>.schema.json")
+	since := flags.String("since", "", "only export posts created after this RFC 3339 time")
+	state := flags.String("state", "", "file remembering where the export stopped, for incremental exports")
+	grace := flags.Duration("grace", EXPORT_GRACE, "leave out the posts created this close to now, they may still be being saved")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var after time.Time
+	if *since != "" {
+		t, err := time.Parse(time.RFC3339Nano, *since)
+		if err != nil {
+			return errors.Wrap(err, "bad -since")
+		}
+		after = t
+	}
+	if *state != "" && *since == "" {
+		t, err := readExportState(*state)
+		if err != nil {
+			return err
+		}
+		after = t
+	}
+	until := time.Now().Add(-*grace)
+	if until.Before(after) {
+		until = after
+	}
+
+	if *format == "parquet" && *out == "" {
+		return errors.New("parquet needs an -out file")
+	}
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+
+		if *schema == "" {
+			*schema = *out + ".schema.json"
+		}
+	}
+	if *schema != "" {
+		js, _ := json.MarshalIndent(exportSchema, "", "  ")
+		if err := ioutil.WriteFile(*schema, append(js, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+
+	rw, err := newRecordWriter(*format, w)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	emit := func(id string, p *Post) error {
+		if err := rw.Write(newExportRecord(id, p)); err != nil {
+			return err
+		}
+		count++
+		return nil
+	}
+
+	ctx := context.Background()
+	switch *source {
+	case "es":
+		var client *elastic.Client
+		if client, err = newESClient(ES_URL); err == nil {
+			err = exportFromES(ctx, client, after, until, emit)
+		}
+	case "bigtable":
+		err = exportFromBigTable(ctx, after, until, emit)
+	default:
+		err = fmt.Errorf("unknown source %q, use es or bigtable", *source)
+	}
+	if err != nil {
+		return err
+	}
+	if err := rw.Close(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Exported %d posts created after %s until %s.\n", count, after.Format(time.RFC3339), until.Format(time.RFC3339))
+	// Only move the state forward once the whole export has been written.
+	if *state != "" {
+		return ioutil.WriteFile(*state, []byte(until.Format(time.RFC3339Nano)+"\n"), 0644)
+	}
+	return nil
+}
+
+// The time a previous run stopped at, or the zero time if there was no previous run.
+func readExportState(path string) (time.Time, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(b)))
+	return t, errors.Wrapf(err, "bad state file %s", path)
+}
+
+// Function that scrolls through the posts created after after and until until, oldest post first. Posts
+// from before created was recorded only come with a zero after.
+func exportFromES(ctx context.Context, client *elastic.Client, after, until time.Time, emit func(id string, p *Post) error) error {
+	var query elastic.Query = elastic.NewBoolQuery().Should(
+		elastic.NewRangeQuery("created").Lte(until),
+		elastic.NewBoolQuery().MustNot(elastic.NewExistsQuery("created")),
+	)
+	if !after.IsZero() {
+		query = elastic.NewRangeQuery("created").Gt(after).Lte(until)
+	}
+
+	scroll := client.Scroll(POST_INDEX).Query(query).Sort("created", true).Size(EXPORT_PAGE_SIZE)
+	defer scroll.Clear(context.Background())
+	for {
+		pageCtx, cancel := context.WithTimeout(ctx, esTimeout)
+		searchResult, err := scroll.Do(pageCtx)
+		cancel()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, hit := range searchResult.Hits.Hits {
+			var p Post
+			if err := json.Unmarshal(*hit.Source, &p); err != nil {
+				return errors.Wrapf(err, "post %s", hit.Id)
+			}
+			if err := emit(hit.Id, &p); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Function that reads every row of the BigTable analytics table. Rows are keyed by post id, not by
+// time, so the whole table is read and filtered here.
+func exportFromBigTable(ctx context.Context, after, until time.Time, emit func(id string, p *Post) error) error {
+	client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE, option.WithCredentialsFile(CREDENTIAL_FILE))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var rowErr error
+	err = client.Open(postSchema.Table).ReadRows(ctx, bigtable.InfiniteRange(""), func(row bigtable.Row) bool {
+		id, p, err := decodePostRow(row)
+		if err != nil {
+			rowErr = err
+			return false
+		}
+		if !after.IsZero() && !p.Created.After(after) || p.Created.After(until) {
+			return true
+		}
+		if err := emit(id, p); err != nil {
+			rowErr = err
+			return false
+		}
+		return true
+	}, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	if err != nil {
+		return err
+	}
+	return rowErr
+}
@@ -0,0 +1,336 @@
+package main
+
+// This module is the follow graph between users and the feed built on it:
+//
+//	PUT    /api/v1/users/{username}/follow      follow a user
+//	DELETE /api/v1/users/{username}/follow      stop following them
+//	GET    /api/v1/users/{username}/followers   who follows them, most recent first
+//	GET    /api/v1/users/{username}/following   who they follow, most recent first
+//	GET    /api/v1/feed                         posts of the users you follow, newest first
+//
+// Lists come in pages of ?limit= items. A page that is followed by more carries next_cursor, pass it back
+// as ?cursor= to get the next one. The feed takes the lat, lon and range of /search to only show posts
+// nearby. Each follow is one document in the follow index, with the id follower:followee.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/olivere/elastic"
+	"github.com/pkg/errors"
+)
+
+const (
+	FOLLOW_INDEX = "follow"
+	FOLLOW_TYPE  = "follow"
+
+	MAX_FEED_FOLLOWING = 1000 // followed users the feed is built from, the most recently followed win.
+)
+
+// Follow is one user following another.
+type Follow struct {
+	Follower string    `json:"follower"`
+	Followee string    `json:"followee"`
+	Created  time.Time `json:"created"`
+}
+
+// FollowPage is one page of a follower or following list.
+type FollowPage struct {
+	Follows    []Follow `json:"follows"`
+	NextCursor string   `json:"next_cursor,omitempty"`
+}
+
+// PostPage is one page of the feed.
+type PostPage struct {
+	Posts      []Post `json:"posts"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// Usernames only contain [a-z0-9_], so the colon is unambiguous.
+func followId(follower, followee string) string {
+	return follower + ":" + followee
+}
+
+// Handler for PUT and DELETE on /users/{username}/follow. Both are idempotent and answer 204.
+func handlerFollow(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
+	w.Header().Set("Access-Control-Allow-Methods", "PUT,DELETE")
+
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	follower := getUsername(r)
+	followee := mux.Vars(r)["username"]
+
+	var err error
+	switch {
+	case r.Method == "DELETE":
+		err = unfollowUser(r.Context(), esClient, follower, followee)
+	case follower == followee:
+		err = badRequest("follow_self", "You cannot follow yourself", nil)
+	default:
+		err = followUser(r.Context(), esClient, follower, followee)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler for GET /users/{username}/followers.
+func handlerFollowers(w http.ResponseWriter, r *http.Request) {
+	serveFollows(w, r, "followee")
+}
+
+// Handler for GET /users/{username}/following.
+func handlerFollowing(w http.ResponseWriter, r *http.Request) {
+	serveFollows(w, r, "follower")
+}
+
+// Serve the page of follows whose field is the user in the path.
+func serveFollows(w http.ResponseWriter, r *http.Request, field string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
+
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	var v ValidationError
+	limit := v.Limit("limit", r.URL.Query().Get("limit"))
+	after := v.Cursor("cursor", r.URL.Query().Get("cursor"))
+	if err := v.Err(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	follows, next, err := listFollows(r.Context(), esClient, field, mux.Vars(r)["username"], after, limit)
+	if err != nil {
+		writeError(w, r, internalError("Failed to read follows from ElasticSearch", err))
+		return
+	}
+
+	page := FollowPage{Follows: follows}
+	if next != nil {
+		page.NextCursor = encodeCursor(next)
+	}
+	js, err := json.Marshal(page)
+	if err != nil {
+		writeError(w, r, internalError("Failed to parse follows into JSON format", err))
+		return
+	}
+	w.Write(js)
+}
+
+// Handler for GET /feed.
+func handlerFeed(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
+
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	fmt.Println("Received one request for the feed")
+
+	query := r.URL.Query()
+	var v ValidationError
+	limit := v.Limit("limit", query.Get("limit"))
+	after := v.Cursor("cursor", query.Get("cursor"))
+	// The area is optional, without it the feed covers everywhere.
+	var near *Location
+	var ran string
+	if query.Get("lat") != "" || query.Get("lon") != "" {
+		loc := v.Location(query.Get("lat"), query.Get("lon"))
+		near = &loc
+		ran = v.Range("range", query.Get("range"))
+	}
+	if err := v.Err(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	posts, next, err := readFeed(r.Context(), esClient, getUsername(r), near, ran, after, limit)
+	if err != nil {
+		writeError(w, r, internalError("Failed to read the feed from ElasticSearch", err))
+		return
+	}
+	addViewerReactions(r.Context(), esClient, getUsername(r), posts)
+
+	page := PostPage{Posts: posts}
+	if next != nil {
+		page.NextCursor = encodeCursor(next)
+	}
+	js, err := json.Marshal(page)
+	if err != nil {
+		writeError(w, r, internalError("Failed to parse posts into JSON format", err))
+		return
+	}
+	w.Write(js)
+}
+
+/**
+ *  Helper functions:
+ */
+// Function that makes follower follow followee. Following someone twice is not an error.
+func followUser(ctx context.Context, client *elastic.Client, follower, followee string) error {
+	user, err := userStore.Get(ctx, followee)
+	if err != nil {
+		return err
+	}
+	if user.Disabled {
+		return ErrNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	_, err = client.Index().
+		Index(FOLLOW_INDEX).
+		Type(FOLLOW_TYPE).
+		Id(followId(follower, followee)).
+		OpType("create"). // keep the date of the first follow.
+		BodyJson(Follow{Follower: follower, Followee: followee, Created: time.Now()}).
+		Refresh("wait_for").
+		Do(ctx)
+	if err != nil && !elastic.IsConflict(err) {
+		return err
+	}
+
+	fmt.Printf("%s follows %s\n", follower, followee)
+	return nil
+}
+
+// Function that makes follower stop following followee. Unfollowing someone not followed is not an error.
+func unfollowUser(ctx context.Context, client *elastic.Client, follower, followee string) error {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	_, err := client.Delete().
+		Index(FOLLOW_INDEX).
+		Type(FOLLOW_TYPE).
+		Id(followId(follower, followee)).
+		Refresh("wait_for").
+		Do(ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		return err
+	}
+
+	fmt.Printf("%s no longer follows %s\n", follower, followee)
+	return nil
+}
+
+// Function that removes every follow from or to a user, e.g. when the user is deleted.
+func deleteFollows(ctx context.Context, client *elastic.Client, username string) error {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	_, err := client.DeleteByQuery(FOLLOW_INDEX).
+		Query(elastic.NewBoolQuery().Should(
+			elastic.NewTermQuery("follower", username),
+			elastic.NewTermQuery("followee", username),
+		)).
+		Refresh("true").
+		Do(ctx)
+	return err
+}
+
+// Function that reads one page of the follows whose field ("follower" or "followee") is username, most
+// recent first. It returns the sort values of the last follow when there may be another page.
+func listFollows(ctx context.Context, client *elastic.Client, field, username string, after []interface{}, limit int) ([]Follow, []interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	// The other user breaks ties, together with the date it is unique for a given username.
+	other := "followee"
+	if field == "followee" {
+		other = "follower"
+	}
+	search := client.Search().
+		Index(FOLLOW_INDEX).
+		Query(elastic.NewTermQuery(field, username)).
+		SortBy(elastic.NewFieldSort("created").Desc(), elastic.NewFieldSort(other).Asc()).
+		Size(limit)
+	if after != nil {
+		search = search.SearchAfter(after...)
+	}
+	searchResult, err := search.Do(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	follows := make([]Follow, 0, len(searchResult.Hits.Hits))
+	for _, hit := range searchResult.Hits.Hits {
+		var f Follow
+		if err := json.Unmarshal(*hit.Source, &f); err != nil {
+			return nil, nil, errors.Wrapf(err, "follow %s", hit.Id)
+		}
+		follows = append(follows, f)
+	}
+	return follows, nextPage(searchResult, limit), nil
+}
+
+// Function that reads one page of the posts of the users username follows, newest first, optionally
+// only those within ran of near.
+func readFeed(ctx context.Context, client *elastic.Client, username string, near *Location, ran string, after []interface{}, limit int) ([]Post, []interface{}, error) {
+	following, _, err := listFollows(ctx, client, "follower", username, nil, MAX_FEED_FOLLOWING)
+	if err != nil {
+		return nil, nil, err
+	}
+	posts := make([]Post, 0, limit)
+	if len(following) == 0 {
+		return posts, nil, nil
+	}
+
+	users := make([]interface{}, len(following))
+	for i, f := range following {
+		users[i] = f.Followee
+	}
+	query := elastic.NewBoolQuery().Filter(elastic.NewTermsQuery("user", users...))
+	if near != nil {
+		query = query.Filter(elastic.NewGeoDistanceQuery("location").Distance(ran).Lat(near.Lat).Lon(near.Lon))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	search := client.Search().
+		Index(POST_INDEX).
+		Query(query).
+		SortBy(elastic.NewFieldSort("created").Desc(), elastic.NewFieldSort("id").Desc()).
+		Size(limit)
+	if after != nil {
+		search = search.SearchAfter(after...)
+	}
+	searchResult, err := search.Do(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, hit := range searchResult.Hits.Hits {
+		var p Post
+		if err := json.Unmarshal(*hit.Source, &p); err != nil {
+			return nil, nil, errors.Wrapf(err, "post %s", hit.Id)
+		}
+		posts = append(posts, p)
+	}
+	return posts, nextPage(searchResult, limit), nil
+}
+
+// The sort values to continue after, or nil if this was the last page.
+func nextPage(searchResult *elastic.SearchResult, limit int) []interface{} {
+	hits := searchResult.Hits.Hits
+	if len(hits) < limit {
+		return nil
+	}
+	return hits[len(hits)-1].Sort
+}
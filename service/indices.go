@@ -0,0 +1,642 @@
+package main
+
+// This module declares the ES indices of the service and every version of their mappings. The names the
+// code uses (post, user) are aliases of versioned indices (post_v2, ...), so a mapping can change
+// without downtime: the migration creates the next version, copies the documents over and then swaps
+// the alias in one atomic step. The version is kept in the mapping's _meta, and the server refuses to
+// start against an index older than the one it was built for. A newer one is only logged, so that the
+// instances of the previous build keep running during a rolling deploy. Migrations are run with the
+// admin CLI, e.g. "go run *.go index migrate post".
+//
+// To change a mapping, append a mappingVersion to the index below; never edit one that has shipped.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/olivere/elastic"
+)
+
+// esIndex is one ES index the service uses. Name is the alias, Versions every mapping it has had,
+// oldest first; the last one is what this build reads and writes.
+type esIndex struct {
+	Name     string
+	Versions []mappingVersion
+}
+
+// mappingVersion is one version of the mapping of an index.
+type mappingVersion struct {
+	Version int
+	Type    string // mapping type, the only one of the index.
+	Mapping string // mapping of Type without _meta, which is filled in with the version.
+
+	// Painless script applied to every document copied into this version, empty to copy as is.
+	Script string
+}
+
+var esIndices = []esIndex{
+	{
+		Name: POST_INDEX,
+		Versions: []mappingVersion{
+			{
+				// The index created before versioning. Only location (and, on newer deployments, hash and
+				// created) were declared, ES guessed the rest.
+				Version: 1,
+				Type:    POST_TYPE,
+				Mapping: `{
+                    "properties": {
+                        "location": {"type": "geo_point"},
+                        "hash":     {"type": "keyword"},
+                        "created":  {"type": "date"}
+                    }
+                }`,
+			},
+			{
+				// Every field declared. The mapping type stays the same so instances still running the
+				// previous build can keep writing through the alias while the new one rolls out.
+				Version: 2,
+				Type:    POST_TYPE,
+				Mapping: `{
+                    "properties": {
+                        "user":         {"type": "keyword"},
+                        "message":      {"type": "text"},
+                        "location":     {"type": "geo_point"},
+                        "url":          {"type": "keyword", "index": false},
+                        "type":         {"type": "keyword"},
+                        "face":         {"type": "float"},
+                        "hash":         {"type": "keyword"},
+                        "duplicate_of": {"type": "keyword"},
+                        "created":      {"type": "date"}
+                    }
+                }`,
+			},
+			{
+				// The post id as a field, to break ties when sorting by date (ES cannot sort on _id).
+				Version: 3,
+				Type:    POST_TYPE,
+				Mapping: `{
+                    "properties": {
+                        "id":           {"type": "keyword"},
+                        "user":         {"type": "keyword"},
+                        "message":      {"type": "text"},
+                        "location":     {"type": "geo_point"},
+                        "url":          {"type": "keyword", "index": false},
+                        "type":         {"type": "keyword"},
+                        "face":         {"type": "float"},
+                        "hash":         {"type": "keyword"},
+                        "duplicate_of": {"type": "keyword"},
+                        "created":      {"type": "date"}
+                    }
+                }`,
+				Script: `ctx._source.id = ctx._id;`,
+			},
+			{
+				// Reaction counters (see reaction.go).
+				Version: 4,
+				Type:    POST_TYPE,
+				Mapping: `{
+                    "properties": {
+                        "id":             {"type": "keyword"},
+                        "user":           {"type": "keyword"},
+                        "message":        {"type": "text"},
+                        "location":       {"type": "geo_point"},
+                        "url":            {"type": "keyword", "index": false},
+                        "type":           {"type": "keyword"},
+                        "face":           {"type": "float"},
+                        "hash":           {"type": "keyword"},
+                        "duplicate_of":   {"type": "keyword"},
+                        "created":        {"type": "date"},
+                        "reactions":      {"type": "object", "dynamic": true},
+                        "reaction_count": {"type": "long"}
+                    }
+                }`,
+				Script: `if (ctx._source.reaction_count == null) { ctx._source.reaction_count = 0; }`,
+			},
+			{
+				// Comment counter (see comment.go).
+				Version: 5,
+				Type:    POST_TYPE,
+				Mapping: `{
+                    "properties": {
+                        "id":             {"type": "keyword"},
+                        "user":           {"type": "keyword"},
+                        "message":        {"type": "text"},
+                        "location":       {"type": "geo_point"},
+                        "url":            {"type": "keyword", "index": false},
+                        "type":           {"type": "keyword"},
+                        "face":           {"type": "float"},
+                        "hash":           {"type": "keyword"},
+                        "duplicate_of":   {"type": "keyword"},
+                        "created":        {"type": "date"},
+                        "reactions":      {"type": "object", "dynamic": true},
+                        "reaction_count": {"type": "long"},
+                        "comment_count":  {"type": "long"}
+                    }
+                }`,
+				Script: `if (ctx._source.comment_count == null) { ctx._source.comment_count = 0; }`,
+			},
+		},
+	},
+	{
+		Name: USER_INDEX,
+		Versions: []mappingVersion{
+			{
+				Version: 1,
+				Type:    USER_TYPE,
+				Mapping: `{"properties": {}}`, // dynamic, ES guesses the field types.
+			},
+			{
+				// Strict, with a keyword username and hashed passwords. Plain text passwords of existing
+				// users move to legacy_password until their next login. Instances of the previous build
+				// can no longer sign users up once the alias is swapped, so deploy right after migrating.
+				Version: 2,
+				Type:    USER_TYPE,
+				Mapping: `{
+                    "dynamic": "strict",
+                    "properties": {
+                        "username":        {"type": "keyword"},
+                        "password_hash":   {"type": "keyword", "index": false},
+                        "legacy_password": {"type": "keyword", "index": false},
+                        "age":             {"type": "integer"},
+                        "gender":          {"type": "keyword"},
+                        "disabled":        {"type": "boolean"},
+                        "created":         {"type": "date"},
+                        "last_login":      {"type": "date"}
+                    }
+                }`,
+				Script: `if (ctx._source.containsKey('password')) { ctx._source.legacy_password = ctx._source.remove('password'); }`,
+			},
+			{
+				// Profile fields (see profile.go).
+				Version: 3,
+				Type:    USER_TYPE,
+				Mapping: `{
+                    "dynamic": "strict",
+                    "properties": {
+                        "username":        {"type": "keyword"},
+                        "password_hash":   {"type": "keyword", "index": false},
+                        "legacy_password": {"type": "keyword", "index": false},
+                        "age":             {"type": "integer"},
+                        "gender":          {"type": "keyword"},
+                        "disabled":        {"type": "boolean"},
+                        "created":         {"type": "date"},
+                        "last_login":      {"type": "date"},
+                        "display_name":    {"type": "text"},
+                        "bio":             {"type": "text"},
+                        "avatar_url":      {"type": "keyword", "index": false},
+                        "avatar_object":   {"type": "keyword", "index": false},
+                        "privacy": {
+                            "properties": {
+                                "private":     {"type": "boolean"},
+                                "hide_age":    {"type": "boolean"},
+                                "hide_gender": {"type": "boolean"}
+                            }
+                        }
+                    }
+                }`,
+			},
+		},
+	},
+	{
+		Name: FOLLOW_INDEX,
+		Versions: []mappingVersion{
+			{
+				Version: 1,
+				Type:    FOLLOW_TYPE,
+				Mapping: `{
+                    "dynamic": "strict",
+                    "properties": {
+                        "follower": {"type": "keyword"},
+                        "followee": {"type": "keyword"},
+                        "created":  {"type": "date"}
+                    }
+                }`,
+			},
+		},
+	},
+	{
+		Name: REACTION_INDEX,
+		Versions: []mappingVersion{
+			{
+				Version: 1,
+				Type:    REACTION_TYPE,
+				Mapping: `{
+                    "dynamic": "strict",
+                    "properties": {
+                        "post_id": {"type": "keyword"},
+                        "user":    {"type": "keyword"},
+                        "kind":    {"type": "keyword"},
+                        "created": {"type": "date"}
+                    }
+                }`,
+			},
+		},
+	},
+	{
+		Name: COMMENT_INDEX,
+		Versions: []mappingVersion{
+			{
+				Version: 1,
+				Type:    COMMENT_TYPE,
+				Mapping: `{
+                    "dynamic": "strict",
+                    "properties": {
+                        "id":        {"type": "keyword"},
+                        "post_id":   {"type": "keyword"},
+                        "parent_id": {"type": "keyword"},
+                        "user":      {"type": "keyword"},
+                        "message":   {"type": "text"},
+                        "created":   {"type": "date"},
+                        "edited":    {"type": "date"},
+                        "deleted":   {"type": "boolean"}
+                    }
+                }`,
+			},
+		},
+	},
+	{
+		Name: ALERT_INDEX,
+		Versions: []mappingVersion{
+			{
+				// Saved areas (see alert.go), matched against posts through shape. Cells are as fine as
+				// 2.5% of the size of each area: an explicit precision would index every area down to it.
+				Version: 1,
+				Type:    ALERT_TYPE,
+				Mapping: `{
+                    "dynamic": "strict",
+                    "properties": {
+                        "id":       {"type": "keyword"},
+                        "user":     {"type": "keyword"},
+                        "name":     {"type": "keyword", "index": false},
+                        "circle":   {"type": "object", "enabled": false},
+                        "polygon":  {"type": "object", "enabled": false},
+                        "keywords": {"type": "keyword", "index": false},
+                        "min_face": {"type": "float"},
+                        "type":     {"type": "keyword"},
+                        "created":  {"type": "date"},
+                        "shape":    {"type": "geo_shape", "tree": "quadtree", "distance_error_pct": 0.025}
+                    }
+                }`,
+			},
+		},
+	},
+	{
+		Name: NOTIFICATION_INDEX,
+		Versions: []mappingVersion{
+			{
+				Version: 1,
+				Type:    NOTIFICATION_TYPE,
+				Mapping: `{
+                    "dynamic": "strict",
+                    "properties": {
+                        "id":        {"type": "keyword"},
+                        "user":      {"type": "keyword"},
+                        "area_id":   {"type": "keyword"},
+                        "area_name": {"type": "keyword", "index": false},
+                        "post_id":   {"type": "keyword"},
+                        "post":      {"type": "object", "enabled": false},
+                        "created":   {"type": "date"},
+                        "read":      {"type": "boolean"}
+                    }
+                }`,
+			},
+		},
+	},
+	{
+		Name: WEBHOOK_INDEX,
+		Versions: []mappingVersion{
+			{
+				Version: 1,
+				Type:    WEBHOOK_TYPE,
+				Mapping: `{
+                    "dynamic": "strict",
+                    "properties": {
+                        "id":      {"type": "keyword"},
+                        "url":     {"type": "keyword", "index": false},
+                        "secret":  {"type": "keyword", "index": false},
+                        "events":  {"type": "keyword"},
+                        "area":    {"type": "object", "enabled": false},
+                        "created": {"type": "date"}
+                    }
+                }`,
+			},
+		},
+	},
+	{
+		Name: DELIVERY_INDEX,
+		Versions: []mappingVersion{
+			{
+				Version: 1,
+				Type:    DELIVERY_TYPE,
+				Mapping: `{
+                    "dynamic": "strict",
+                    "properties": {
+                        "id":           {"type": "keyword"},
+                        "webhook_id":   {"type": "keyword"},
+                        "event":        {"type": "keyword"},
+                        "post_id":      {"type": "keyword"},
+                        "payload":      {"type": "text", "index": false},
+                        "status":       {"type": "keyword"},
+                        "attempts":     {"type": "integer"},
+                        "next_attempt": {"type": "date"},
+                        "last_code":    {"type": "integer"},
+                        "last_error":   {"type": "text", "index": false},
+                        "created":      {"type": "date"},
+                        "delivered":    {"type": "date"}
+                    }
+                }`,
+			},
+		},
+	},
+}
+
+func (idx esIndex) latest() mappingVersion {
+	return idx.Versions[len(idx.Versions)-1]
+}
+
+// Name of the index holding version v of the documents behind alias name, e.g. post_v2.
+func versionedName(name string, v int) string {
+	return fmt.Sprintf("%s_v%d", name, v)
+}
+
+// Find the declaration of the named index.
+func findIndex(name string) (esIndex, error) {
+	for _, idx := range esIndices {
+		if idx.Name == name {
+			return idx, nil
+		}
+	}
+	return esIndex{}, fmt.Errorf("unknown index %q", name)
+}
+
+// Function that creates every index the service needs that does not exist yet, and checks that the
+// existing ones have the mapping version this build expects.
+func createIndexIfNotExist(ctx context.Context, client *elastic.Client) error {
+	for _, idx := range esIndices {
+		live, version, err := liveIndex(ctx, client, idx.Name)
+		if err != nil {
+			return err
+		}
+		if live == "" {
+			if _, err := createIndex(ctx, client, idx); err != nil {
+				return err
+			}
+			continue
+		}
+		want := idx.latest().Version
+		if version > want {
+			// Another instance was deployed with a newer build and migrated, this one is on its way out.
+			fmt.Printf("Index %s (%s) has mapping version %d, newer than the %d of this build.\n", idx.Name, live, version, want)
+			continue
+		}
+		if version < want {
+			return fmt.Errorf("index %s (%s) has mapping version %d but this build needs %d, run \"%s index migrate %s\"",
+				idx.Name, live, version, want, CLI_NAME, idx.Name)
+		}
+	}
+	return nil
+}
+
+// Function that finds the index behind alias name and its mapping version. It returns an empty name if
+// there is no such index. An index without a version in its _meta predates versioning and is version 1.
+func liveIndex(ctx context.Context, client *elastic.Client, name string) (string, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	res, err := client.GetMapping().Index(name).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return "", 0, nil
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	// {"post_v2": {"mappings": {"_doc": {"_meta": {"version": 2}, ...}}}}
+	js, _ := json.Marshal(res)
+	var mappings map[string]struct {
+		Mappings map[string]struct {
+			Meta struct {
+				Version int `json:"version"`
+			} `json:"_meta"`
+		} `json:"mappings"`
+	}
+	if err := json.Unmarshal(js, &mappings); err != nil {
+		return "", 0, err
+	}
+	if len(mappings) != 1 {
+		return "", 0, fmt.Errorf("%s points at %d indices instead of one", name, len(mappings))
+	}
+
+	for index, m := range mappings {
+		version := 1
+		for _, typ := range m.Mappings {
+			if typ.Meta.Version != 0 {
+				version = typ.Meta.Version
+			}
+		}
+		return index, version, nil
+	}
+	return "", 0, nil
+}
+
+// Create the latest version of idx and point its alias at it, unless the alias exists. It reports
+// whether the index was created.
+func createIndex(ctx context.Context, client *elastic.Client, idx esIndex) (bool, error) {
+	live, _, err := liveIndex(ctx, client, idx.Name)
+	if err != nil || live != "" {
+		return false, err
+	}
+
+	v := idx.latest()
+	index := versionedName(idx.Name, v.Version)
+	if _, err := createVersionedIndex(ctx, client, index, v); err != nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+	if _, err := client.Alias().Add(index, idx.Name).Do(ctx); err != nil {
+		return false, err
+	}
+	fmt.Printf("Index is created: %s -> %s\n", idx.Name, index)
+	return true, nil
+}
+
+// Create an index called name with mapping version v, unless it exists. It reports whether it was created.
+func createVersionedIndex(ctx context.Context, client *elastic.Client, name string, v mappingVersion) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	exists, err := client.IndexExists(name).Do(ctx)
+	if err != nil || exists {
+		return false, err
+	}
+
+	var mapping map[string]interface{}
+	if err := json.Unmarshal([]byte(v.Mapping), &mapping); err != nil {
+		return false, fmt.Errorf("bad mapping version %d: %v", v.Version, err)
+	}
+	mapping["_meta"] = map[string]interface{}{"version": v.Version}
+	body := map[string]interface{}{
+		"mappings": map[string]interface{}{v.Type: mapping},
+	}
+	if _, err := client.CreateIndex(name).BodyJson(body).Do(ctx); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Function that moves the documents behind the alias of idx to the latest mapping version: it creates the
+// new index, copies every document over, then swaps the alias. Reads and writes keep working throughout;
+// posts created while copying are caught up before and after the swap, but updates and deletes made in
+// that window are not carried over. The old index is kept for rollback, unless it predates versioning
+// and has the name the alias needs: then it is deleted by the swap, so writes to it are blocked for the
+// last catch up and the swap, and fail for that moment.
+func migrateIndex(ctx context.Context, client *elastic.Client, idx esIndex) error {
+	old, version, err := liveIndex(ctx, client, idx.Name)
+	if err != nil {
+		return err
+	}
+	if old == "" {
+		_, err := createIndex(ctx, client, idx)
+		return err
+	}
+
+	latest := idx.latest()
+	if version == latest.Version {
+		fmt.Printf("Index %s (%s) is up to date at version %d.\n", idx.Name, old, version)
+		return nil
+	}
+	if version > latest.Version {
+		return fmt.Errorf("index %s (%s) has version %d, newer than this build knows (%d)", idx.Name, old, version, latest.Version)
+	}
+
+	// Scripts of every version skipped over run one after another.
+	var scripts []string
+	for _, v := range idx.Versions {
+		if v.Version > version && v.Script != "" {
+			scripts = append(scripts, v.Script)
+		}
+	}
+	opts := reindexOptions{Type: latest.Type, Script: strings.Join(scripts, "\n")}
+
+	target := versionedName(idx.Name, latest.Version)
+	created, err := createVersionedIndex(ctx, client, target, latest)
+	if err != nil {
+		return err
+	}
+	if !created {
+		return fmt.Errorf("%s already exists, probably from a migration that did not finish; drop it and try again", target)
+	}
+
+	fmt.Printf("Migrating %s from version %d (%s) to %d (%s).\n", idx.Name, version, old, latest.Version, target)
+	n, err := reindex(ctx, client, old, target, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Copied %d documents.\n", n)
+
+	// Documents created while the copy ran.
+	opts.CreateOnly = true
+	if _, err := reindex(ctx, client, old, target, opts); err != nil {
+		return err
+	}
+
+	var remove elastic.AliasAction = elastic.NewAliasRemoveAction(idx.Name).Index(old)
+	if old == idx.Name {
+		// An unversioned index has the alias' name, it has to go in the same step the alias appears, and
+		// there is no catching up after that: stop writes to it and copy what came in meanwhile first.
+		remove = elastic.NewAliasRemoveIndexAction(old)
+		if err := setWriteBlock(ctx, client, old, true); err != nil {
+			return err
+		}
+		if _, err := reindex(ctx, client, old, target, opts); err != nil {
+			setWriteBlock(context.Background(), client, old, false)
+			return err
+		}
+	}
+	swapCtx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+	if _, err := client.Alias().Action(remove, elastic.NewAliasAddAction(idx.Name).Index(target)).Do(swapCtx); err != nil {
+		if old == idx.Name {
+			setWriteBlock(context.Background(), client, old, false)
+		}
+		return err
+	}
+	fmt.Printf("Alias %s now points at %s.\n", idx.Name, target)
+	if old == idx.Name {
+		return nil
+	}
+
+	// Documents written to the old index in the moment before the swap.
+	if _, err := reindex(ctx, client, old, target, opts); err != nil {
+		return err
+	}
+	fmt.Printf("Old index %s is kept for rollback, drop it once the migration is verified.\n", old)
+	return nil
+}
+
+// Function that makes an index read-only, or writable again.
+func setWriteBlock(ctx context.Context, client *elastic.Client, index string, block bool) error {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	_, err := client.IndexPutSettings(index).
+		BodyJson(map[string]interface{}{"index.blocks.write": block}).
+		Do(ctx)
+	if err != nil {
+		return err
+	}
+	if block {
+		fmt.Printf("Writes to %s are blocked.\n", index)
+	}
+	return nil
+}
+
+// Function that deletes an index and every document in it.
+func dropIndex(ctx context.Context, client *elastic.Client, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	_, err := client.DeleteIndex(name).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// reindexOptions control how documents are copied between indices.
+type reindexOptions struct {
+	Type       string // mapping type of the destination index.
+	Script     string // Painless script applied to every document, may be empty.
+	CreateOnly bool   // only copy documents the destination does not have yet.
+}
+
+// Function that copies every document of index from into index to, returning how many were written. It
+// waits until ES is done, which can take a while, so ctx should not carry the usual esTimeout.
+func reindex(ctx context.Context, client *elastic.Client, from, to string, opts reindexOptions) (int64, error) {
+	dst := elastic.NewReindexDestination().Index(to).Type(opts.Type)
+	service := client.Reindex().
+		Source(elastic.NewReindexSource().Index(from)).
+		WaitForCompletion(true).
+		Refresh("true")
+	if opts.CreateOnly {
+		// Existing documents are version conflicts, which are expected and skipped.
+		dst = dst.OpType("create")
+		service = service.Conflicts("proceed")
+	}
+	if opts.Script != "" {
+		service = service.Script(elastic.NewScript(opts.Script))
+	}
+
+	res, err := service.Destination(dst).Do(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if len(res.Failures) > 0 {
+		return res.Created + res.Updated, fmt.Errorf("%d documents failed to copy", len(res.Failures))
+	}
+	return res.Created + res.Updated, nil
+}
@@ -3,18 +3,22 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"expvar"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"reflect"
-	"strconv"
-
-	"cloud.google.com/go/bigtable"
+	"syscall"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/olivere/elastic"
 	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
 	"google.golang.org/api/option"
 
 	"github.com/gorilla/mux"
@@ -26,7 +30,7 @@ import (
 )
 
 const (
-	POST_INDEX = "post" // database name (for storing posts into Elastic Search).
+	POST_INDEX = "post" // database name (for storing posts into Elastic Search), an alias (see indices.go).
 	POST_TYPE  = "post" // database table name.
 
 	DISTANCE        = "200km"                         // search range.
@@ -34,12 +38,22 @@ const (
 	BUCKET_NAME     = "socialradar-post-images"       // bucket (folder) name of GCS (Google Cloud Storage).
 	CREDENTIAL_FILE = "SocialRadar-576b9b3c0db7.json" // ServiceAccount key file.
 
-	ENABLE_BIGTABLE = false              // Set this to "true" if want to use Google BigTable.
-	PROJECT_ID      = "socialradar"      // for saveToBigTable func.
-	BT_INSTANCE     = "socialradar-post" // BigTable instance id.
-	API_PREFIX      = "/api/v1"
+	PROJECT_ID  = "socialradar"      // for the BigTable analytics sink.
+	BT_INSTANCE = "socialradar-post" // BigTable instance id.
+	BT_TABLE    = "post"             // BigTable table the Dataflow job reads posts from.
+	API_PREFIX  = "/api/v1"
+
+	TEXT_TYPE = "text" // Type of a post that has a message but no media.
+
+	SORT_ENGAGEMENT = "engagement" // sort parameter of /search for the posts with the most reactions and comments first.
+
+	SHUTDOWN_TIMEOUT = 20 * time.Second // time requests in flight get to finish once the instance is told to stop.
 )
 
+// Where the expvar counters are served at /debug/vars. Not on the public port: App Engine only exposes
+// 8080, so the default is only reachable from the instance itself.
+var metricsAddr = envString("METRICS_ADDR", "localhost:8081")
+
 var (
 	mediaTypes = map[string]string{
 		".jpeg": "image",
@@ -63,41 +77,181 @@ type Location struct {
 // Post struct representing what data a user's post contains.
 type Post struct {
 	// `json:"user"` is for json parsing. Otherwise, by default it's 'User' (Same applies to fields below).
+	Id       string   `json:"id"` // also the document id in ES and the object name of the image in GCS.
 	User     string   `json:"user"`
 	Message  string   `json:"message"`
 	Location Location `json:"location"`
 	Url      string   `json:"url"`
 	Type     string   `json:"type"`
 	Face     float64  `json:"face"` // score of if an image contains a face.
+
+	Hash        string    `json:"hash,omitempty"`         // perceptual hash of the image (see phash.go).
+	DuplicateOf string    `json:"duplicate_of,omitempty"` // id of an earlier post of the same user with the same image.
+	Created     time.Time `json:"created"`
+
+	Reactions     map[string]int64 `json:"reactions,omitempty"` // number of reactions of each kind (see reaction.go).
+	ReactionCount int64            `json:"reaction_count"`
+	// Reactions of the user asking, filled in for each response and never stored.
+	MyReactions []string `json:"my_reactions,omitempty"`
+
+	CommentCount int64 `json:"comment_count"` // comments that are not deleted (see comment.go).
 }
 
 // ------------------ MAIN FUNCTION ------------------
 func main() {
+	// With arguments this is the admin CLI, e.g. "go run *.go user list" (see cli.go).
+	if len(os.Args) > 1 {
+		os.Exit(runCLI(os.Args[1:]))
+	}
+
 	fmt.Println("started-service")
-	createIndexIfNotExist()
+	client, err := newESClient(ES_URL)
+	if err != nil {
+		panic(err)
+	}
+	esClient = client
+	userStore = ESUserStore{client: esClient}
+	if err := createIndexIfNotExist(context.Background(), esClient); err != nil {
+		panic(err)
+	}
+	startOutboxRepair()
+	webhooks.Start()
 
-	jwtMiddleware := jwtmiddleware.New(jwtmiddleware.Options{
+	// Set ANALYTICS_SINK=bigtable to feed posts to BigTable for offline analysis.
+	sink, err := newEventSink(context.Background(), analyticsSink)
+	if err != nil {
+		panic(err)
+	}
+	if sink != nil {
+		analytics = NewAnalyticsQueue(sink)
+	}
+
+	// Set EVENT_BUS=redis when more than one instance runs, so that /stream clients see every post.
+	bus, err := newEventBus(eventBusKind)
+	if err != nil {
+		panic(err)
+	}
+	eventBus = bus
+	eventBus.Subscribe(streamHub.Publish)
+
+	// Set NOTIFIER to pick how users hear about posts in their saved areas, besides their inbox.
+	n, err := newNotifier(notifierKind)
+	if err != nil {
+		panic(err)
+	}
+	notifier = n
+
+	// Set RATE_LIMITER=redis when more than one instance runs, so that limits hold across instances.
+	limiter, err := newRateLimiter(rateLimiterKind)
+	if err != nil {
+		panic(err)
+	}
+	rateLimiter = limiter
+
+	// Set SEARCH_CACHE=redis to share cached searches between instances.
+	cache, err := newSearchCache(searchCacheKind)
+	if err != nil {
+		panic(err)
+	}
+	searchCache = cache
+	if _, ok := cache.(*MemoryCache); ok {
+		// Posts of other instances reach this cache through the bus, those of this one are invalidated
+		// again, which is harmless.
+		eventBus.Subscribe(func(e PostEvent) {
+			invalidateSearch(context.Background(), e.Post)
+		})
+	}
+
+	jwtOptions := jwtmiddleware.Options{
 		// Validate whether token can be decoded or not.
 		ValidationKeyGetter: func(token *jwt.Token) (interface{}, error) {
 			return []byte(mySigningKey), nil
 		},
 		SigningMethod: jwt.SigningMethodHS256,
-	})
+		// Report bad tokens with the same JSON error envelope as every other failure.
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err string) {
+			writeError(w, r, errors.Wrap(ErrUnauthorized, err))
+		},
+	}
+	jwtMiddleware := jwtmiddleware.New(jwtOptions)
+	// Browsers cannot set the Authorization header on a WebSocket, live updates also take ?token=.
+	jwtOptions.Extractor = jwtmiddleware.FromFirst(jwtmiddleware.FromAuthHeader, jwtmiddleware.FromParameter("token"))
+	streamMiddleware := jwtmiddleware.New(jwtOptions)
 
 	r := mux.NewRouter()
 	// Add HTTP request methods restriction for the proper handlers.
 	// Also, protect "/post" and "/search" end point with JWT Middleware (now requests to these two end points need to provided a valid token).
-	r.Handle(API_PREFIX+"/post", jwtMiddleware.Handler(http.HandlerFunc(handlerPost))).Methods("POST", "OPTIONS")
-	r.Handle(API_PREFIX+"/search", jwtMiddleware.Handler(http.HandlerFunc(handlerSearch))).Methods("GET", "OPTIONS")
+	r.Handle(API_PREFIX+"/post", jwtMiddleware.Handler(rateLimited("post", http.HandlerFunc(handlerPost)))).Methods("POST", "OPTIONS")
+	r.Handle(API_PREFIX+"/search", jwtMiddleware.Handler(rateLimited("search", http.HandlerFunc(handlerSearch)))).Methods("GET", "OPTIONS")
 	r.Handle(API_PREFIX+"/cluster", jwtMiddleware.Handler(http.HandlerFunc(handlerCluster))).Methods("GET", "OPTIONS")
+	r.Handle(API_PREFIX+"/admin/duplicates", jwtMiddleware.Handler(http.HandlerFunc(handlerDuplicates))).Methods("GET", "OPTIONS")
+	r.Handle(API_PREFIX+"/admin/webhooks", jwtMiddleware.Handler(http.HandlerFunc(handlerWebhooks))).Methods("GET", "POST", "OPTIONS")
+	r.Handle(API_PREFIX+"/admin/webhooks/{id}", jwtMiddleware.Handler(http.HandlerFunc(handlerWebhook))).Methods("DELETE", "OPTIONS")
+	r.Handle(API_PREFIX+"/admin/webhooks/{id}/deliveries", jwtMiddleware.Handler(http.HandlerFunc(handlerDeliveries))).Methods("GET", "OPTIONS")
+	r.Handle(API_PREFIX+"/admin/webhooks/deliveries/{id}/retry", jwtMiddleware.Handler(http.HandlerFunc(handlerRetryDelivery))).Methods("POST", "OPTIONS")
+	r.Handle(API_PREFIX+"/users/{username}", jwtMiddleware.Handler(http.HandlerFunc(handlerProfile))).Methods("GET", "PATCH", "OPTIONS")
+	r.Handle(API_PREFIX+"/me", jwtMiddleware.Handler(http.HandlerFunc(handlerProfile))).Methods("GET", "PATCH", "OPTIONS")
+	r.Handle(API_PREFIX+"/users/{username}/follow", jwtMiddleware.Handler(http.HandlerFunc(handlerFollow))).Methods("PUT", "DELETE", "OPTIONS")
+	r.Handle(API_PREFIX+"/users/{username}/followers", jwtMiddleware.Handler(http.HandlerFunc(handlerFollowers))).Methods("GET", "OPTIONS")
+	r.Handle(API_PREFIX+"/users/{username}/following", jwtMiddleware.Handler(http.HandlerFunc(handlerFollowing))).Methods("GET", "OPTIONS")
+	r.Handle(API_PREFIX+"/feed", jwtMiddleware.Handler(http.HandlerFunc(handlerFeed))).Methods("GET", "OPTIONS")
+	r.Handle(API_PREFIX+"/posts/{id}", jwtMiddleware.Handler(http.HandlerFunc(handlerDeletePost))).Methods("DELETE", "OPTIONS")
+	r.Handle(API_PREFIX+"/posts/{id}/reactions/{kind}", jwtMiddleware.Handler(http.HandlerFunc(handlerReaction))).Methods("PUT", "DELETE", "OPTIONS")
+	r.Handle(API_PREFIX+"/posts/{id}/comments", jwtMiddleware.Handler(http.HandlerFunc(handlerComments))).Methods("GET", "OPTIONS")
+	r.Handle(API_PREFIX+"/posts/{id}/comments", jwtMiddleware.Handler(rateLimited("comment", http.HandlerFunc(handlerComments)))).Methods("POST")
+	r.Handle(API_PREFIX+"/posts/{id}/comments/{comment}", jwtMiddleware.Handler(http.HandlerFunc(handlerComment))).Methods("PATCH", "DELETE", "OPTIONS")
+	r.Handle(API_PREFIX+"/areas", jwtMiddleware.Handler(http.HandlerFunc(handlerAreas))).Methods("GET", "POST", "OPTIONS")
+	r.Handle(API_PREFIX+"/areas/{id}", jwtMiddleware.Handler(http.HandlerFunc(handlerArea))).Methods("DELETE", "OPTIONS")
+	r.Handle(API_PREFIX+"/notifications", jwtMiddleware.Handler(http.HandlerFunc(handlerNotifications))).Methods("GET", "OPTIONS")
+	r.Handle(API_PREFIX+"/notifications/{id}", jwtMiddleware.Handler(http.HandlerFunc(handlerNotification))).Methods("PATCH", "OPTIONS")
+	r.Handle(API_PREFIX+"/stream", streamMiddleware.Handler(http.HandlerFunc(handlerStream))).Methods("GET")
+	r.Handle(API_PREFIX+"/stream/events", streamMiddleware.Handler(http.HandlerFunc(handlerEvents))).Methods("GET", "OPTIONS")
+
+	r.Handle(API_PREFIX+"/login", rateLimited("login", http.HandlerFunc(handlerLogin))).Methods("POST", "OPTIONS")
+	r.Handle(API_PREFIX+"/signup", rateLimited("signup", http.HandlerFunc(handlerSignup))).Methods("POST", "OPTIONS")
+
+	// Backend endpoints. Not on http.DefaultServeMux, importing expvar adds /debug/vars to it.
+	public := http.NewServeMux()
+	public.Handle(API_PREFIX+"/", withRequestId(r))
+	// Health checks polled by App Engine (see app.yaml).
+	public.HandleFunc("/liveness_check", handlerLiveness)
+	public.Handle("/readiness_check", withRequestId(http.HandlerFunc(handlerReadiness)))
+
+	metrics := http.NewServeMux()
+	metrics.Handle("/debug/vars", expvar.Handler())
+	go func() {
+		log.Fatal(http.ListenAndServe(metricsAddr, metrics))
+	}()
+
+	server := &http.Server{Addr: ":8080", Handler: public}
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
 
-	r.Handle(API_PREFIX+"/login", http.HandlerFunc(handlerLogin)).Methods("POST", "OPTIONS")
-	r.Handle(API_PREFIX+"/signup", http.HandlerFunc(handlerSignup)).Methods("POST", "OPTIONS")
+	// App Engine sends SIGTERM before it stops an instance.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	<-stop
+	shutdown(server)
+}
 
-	// Backend endpoints.
-	http.Handle(API_PREFIX+"/", r)
+// Function that stops the service: requests in flight get SHUTDOWN_TIMEOUT to finish, then the events
+// still in the analytics queue are written and the sink is closed.
+func shutdown(server *http.Server) {
+	fmt.Println("stopping-service")
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Printf("Failed to finish requests in flight %v.\n", err)
+	}
 
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	if analytics != nil {
+		if err := analytics.Close(); err != nil {
+			fmt.Printf("Failed to close analytics sink %v.\n", err)
+		}
+	}
 }
 
 // ---------------------------------------------------
@@ -119,70 +273,189 @@ func handlerPost(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("Received one post request")
 
 	// Get the username from token.
-	user := r.Context().Value("user")
-	claims := user.(*jwt.Token).Claims
-	username := claims.(jwt.MapClaims)["username"]
-
-	lat, _ := strconv.ParseFloat(r.FormValue("lat"), 64)
-	lon, _ := strconv.ParseFloat(r.FormValue("lon"), 64)
+	username := getUsername(r)
 
+	var v ValidationError
 	p := &Post{
-		User:    username.(string), // (changed) get the username from token.
-		Message: r.FormValue("message"),
-		Location: Location{
-			Lat: lat,
-			Lon: lon,
-		},
+		User:     username, // (changed) get the username from token.
+		Message:  v.Message("message", r.FormValue("message")),
+		Location: v.Location(r.FormValue("lat"), r.FormValue("lon")),
+		Created:  time.Now(),
+	}
+	if err := v.Err(); err != nil {
+		writeError(w, r, err)
+		return
 	}
 
 	id := uuid.New()
-	file, _, err := r.FormFile("image")
-	if err != nil {
-		http.Error(w, "Image is not available", http.StatusBadRequest)
-		fmt.Printf("Image is not available %v.\n", err)
+	p.Id = id
+	var steps []step
+	// Media is optional: a post without a file is a plain status at a location.
+	file, header, err := r.FormFile("image")
+	if err != nil && err != http.ErrMissingFile {
+		writeError(w, r, badRequest("invalid_image", "Image is not available", err))
 		return
 	}
 
-	im, header, _ := r.FormFile("image")
-	defer im.Close()
-	suffix := filepath.Ext(header.Filename) // get the file name and extention.
-
-	// Client needs to know the media type so as to render it.
-	if t, ok := mediaTypes[suffix]; ok {
-		p.Type = t
-	} else {
-		p.Type = "unknown"
-	}
-	// ML Engine only supports jpeg.
-	if suffix == ".jpeg" {
-		if score, err := annotate(im); err != nil {
-			http.Error(w, "Failed to annotate the image", http.StatusInternalServerError)
-			fmt.Printf("Failed to annotate the image %v\n", err)
+	if file == nil {
+		// A post needs something to show, either a message or media.
+		if p.Message == "" {
+			v.Add("message", "is required when no image is attached")
+			writeError(w, r, v.Err())
 			return
+		}
+		p.Type = TEXT_TYPE
+	} else {
+		defer file.Close()
+		suffix := filepath.Ext(header.Filename) // get the file name and extention.
+
+		// Client needs to know the media type so as to render it.
+		if t, ok := mediaTypes[suffix]; ok {
+			p.Type = t
 		} else {
-			p.Face = score
+			p.Type = "unknown"
 		}
+
+		// Catch users re-posting the same photo.
+		if p.Type == "image" && duplicatePolicy != DUPLICATE_OFF {
+			file.Seek(0, io.SeekStart)
+			hash, err := dHash(file)
+			if err != nil {
+				// Not every file with an image suffix decodes, that should not block the post.
+				fmt.Printf("Failed to hash the image %v\n", err)
+			} else {
+				p.Hash = formatHash(hash)
+				dup, err := findDuplicate(r.Context(), esClient, p.User, hash)
+				if err != nil {
+					writeError(w, r, internalError("Failed to read post from ElasticSearch", err))
+					return
+				}
+				if dup != "" && duplicatePolicy == DUPLICATE_REJECT {
+					writeError(w, r, errors.Wrapf(ErrDuplicateImage, "duplicate of post %s", dup))
+					return
+				}
+				p.DuplicateOf = dup
+			}
+		}
+
+		// ML Engine only supports jpeg.
+		if suffix == ".jpeg" {
+			steps = append(steps, step{
+				name: "annotate",
+				run: func(ctx context.Context) error {
+					file.Seek(0, io.SeekStart) // start over when retrying.
+					score, err := annotate(ctx, file)
+					if err != nil {
+						return internalError("Failed to annotate the image", err)
+					}
+					p.Face = score
+					return nil
+				},
+			})
+		}
+
+		steps = append(steps, step{
+			name: "gcs",
+			run: func(ctx context.Context) error {
+				file.Seek(0, io.SeekStart)
+				attrs, err := saveToGCS(ctx, file, BUCKET_NAME, id)
+				if err != nil {
+					return internalError("Failed to save image to GCS", err)
+				}
+				p.Url = attrs.MediaLink
+				return nil
+			},
+			// Nothing refers to the uploaded image if the post is not saved, don't leave it public in the bucket.
+			undo: func(ctx context.Context) error {
+				return deleteFromGCS(ctx, BUCKET_NAME, id)
+			},
+			repair: "gcs.delete",
+		})
+	}
+
+	steps = append(steps, step{
+		name: "es",
+		run: func(ctx context.Context) error {
+			if err := saveToES(ctx, esClient, p, id); err != nil {
+				return internalError("Failed to save post to ElasticSearch", err)
+			}
+			return nil
+		},
+		undo: func(ctx context.Context) error {
+			return deleteFromES(ctx, esClient, id)
+		},
+		repair: "es.delete",
+	})
+
+	if err := runSaga(r.Context(), id, p, steps); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	fmt.Printf("Saved one post to ElasticSearch: %s", p.Message)
+	invalidateSearch(r.Context(), p)
+
+	e := PostEvent{Id: id, Type: POST_CREATED, Post: p, Time: p.Created}
+	if err := eventBus.Publish(e); err != nil {
+		fmt.Printf("Failed to publish post %s to the event bus %v.\n", id, err)
 	}
+	analytics.Publish(e)
+	alerts.Publish(p)
+	webhooks.Publish(e)
+}
 
-	attrs, err := saveToGCS(file, BUCKET_NAME, id)
-	if err != nil {
-		http.Error(w, "Failed to save image to GCS", http.StatusInternalServerError)
-		fmt.Printf("Failed to save image to GCS %v.\n", err)
+// Function that handles a DELETE request of a post, by its author or an admin.
+func handlerDeletePost(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
+	w.Header().Set("Access-Control-Allow-Methods", "DELETE")
+
+	if r.Method == "OPTIONS" {
 		return
 	}
-	p.Url = attrs.MediaLink
 
-	err = saveToES(p, id)
+	id := mux.Vars(r)["id"]
+	fmt.Printf("Received one request to delete post %s\n", id)
+
+	user := getUsername(r)
+	p, err := readPostFromES(r.Context(), esClient, id)
+	if err == nil && p.User != user && !isAdmin(user) {
+		err = ErrForbidden
+	}
 	if err != nil {
-		http.Error(w, "Failed to save post to ElasticSearch", http.StatusInternalServerError)
-		fmt.Printf("Failed to save post to ElasticSearch %v.\n", err)
+		writeError(w, r, err)
 		return
 	}
-	fmt.Printf("Saved one post to ElasticSearch: %s", p.Message)
 
-	if ENABLE_BIGTABLE {
-		saveToBigTable(p, id)
+	if err := deleteFromES(r.Context(), esClient, id); err != nil {
+		writeError(w, r, internalError("Failed to delete post from ElasticSearch", err))
+		return
+	}
+	// The post is gone for clients already, a leftover image is cleaned up by the outbox.
+	if p.Url != "" {
+		if err := deleteFromGCS(r.Context(), BUCKET_NAME, id); err != nil {
+			fmt.Printf("Failed to delete image %s from GCS %v.\n", id, err)
+			recordOutbox(OutboxEntry{PostId: id, Action: "gcs.delete", Error: err.Error()})
+		}
+	}
+	// Its reactions and comments go too, they would otherwise still count for the users who made them.
+	if err := deleteReactions(r.Context(), esClient, id); err != nil {
+		fmt.Printf("Failed to delete the reactions to post %s %v.\n", id, err)
+		recordOutbox(OutboxEntry{PostId: id, Action: "reactions.delete", Error: err.Error()})
+	}
+	if err := deleteComments(r.Context(), esClient, id); err != nil {
+		fmt.Printf("Failed to delete the comments on post %s %v.\n", id, err)
+		recordOutbox(OutboxEntry{PostId: id, Action: "comments.delete", Error: err.Error()})
 	}
+
+	invalidateSearch(r.Context(), p)
+
+	e := PostEvent{Id: id, Type: POST_DELETED, Post: p, Time: time.Now()}
+	if err := eventBus.Publish(e); err != nil {
+		fmt.Printf("Failed to publish the deletion of post %s to the event bus %v.\n", id, err)
+	}
+	webhooks.Publish(e)
+	w.WriteHeader(http.StatusNoContent)
 }
 
 // Function that handles a GET request (search for nearby posts).
@@ -198,25 +471,30 @@ func handlerSearch(w http.ResponseWriter, r *http.Request) {
 
 	fmt.Println("Received one request for search")
 
-	lat, _ := strconv.ParseFloat(r.URL.Query().Get("lat"), 64)
-	lon, _ := strconv.ParseFloat(r.URL.Query().Get("lon"), 64)
+	var v ValidationError
+	loc := v.Location(r.URL.Query().Get("lat"), r.URL.Query().Get("lon"))
 	// range is optional
-	ran := DISTANCE
-	if val := r.URL.Query().Get("range"); val != "" {
-		ran = val + "km"
+	ran := v.Range("range", r.URL.Query().Get("range"))
+	// sort is optional too, "engagement" puts the posts with the most reactions and comments first.
+	sort := r.URL.Query().Get("sort")
+	if sort != "" && sort != SORT_ENGAGEMENT {
+		v.Add("sort", "must be empty or "+SORT_ENGAGEMENT)
+	}
+	if err := v.Err(); err != nil {
+		writeError(w, r, err)
+		return
 	}
 
-	posts, err := readFromES(lat, lon, ran)
+	posts, err := cachedSearch(r.Context(), esClient, loc, ran, sort)
 	if err != nil {
-		http.Error(w, "Failed to read post from ElasticSearch", http.StatusInternalServerError)
-		fmt.Printf("Failed to read post from ElasticSearch %v.\n", err)
+		writeError(w, r, internalError("Failed to read post from ElasticSearch", err))
 		return
 	}
+	addViewerReactions(r.Context(), esClient, getUsername(r), posts)
 
 	js, err := json.Marshal(posts)
 	if err != nil {
-		http.Error(w, "Failed to parse posts into JSON format", http.StatusInternalServerError)
-		fmt.Printf("Failed to parse posts into JSON format %v.\n", err)
+		writeError(w, r, internalError("Failed to parse posts into JSON format", err))
 		return
 	}
 
@@ -243,28 +521,20 @@ func handlerCluster(w http.ResponseWriter, r *http.Request) {
 
 	term := r.URL.Query().Get("term")
 
-	// Create a client
-	client, err := elastic.NewClient(elastic.SetURL(ES_URL), elastic.SetSniff(false))
-	if err != nil {
-		http.Error(w, "ES is not setup", http.StatusInternalServerError)
-		fmt.Printf("ES is not setup %v\n", err)
-		return
-	}
-
 	// Range query.
 	// For details, https://www.elastic.co/guide/en/elasticsearch/reference/current/query-dsl-range-query.html
 	q := elastic.NewRangeQuery(term).Gte(0.9)
 
-	searchResult, err := client.Search().
+	ctx, cancel := context.WithTimeout(r.Context(), esTimeout)
+	defer cancel()
+	searchResult, err := esClient.Search().
 		Index(POST_INDEX).
 		Query(q).
 		Pretty(true).
-		Do(context.Background())
+		Do(ctx)
 	if err != nil {
-		// Handle error
-		m := fmt.Sprintf("Failed to query ES %v", err)
-		fmt.Println(m)
-		http.Error(w, m, http.StatusInternalServerError)
+		writeError(w, r, internalError("Failed to query ES", err))
+		return
 	}
 
 	// searchResult is of type SearchResult and returns hits, suggestions,
@@ -283,11 +553,10 @@ func handlerCluster(w http.ResponseWriter, r *http.Request) {
 		ps = append(ps, p)
 
 	}
+	addViewerReactions(r.Context(), esClient, getUsername(r), ps)
 	js, err := json.Marshal(ps)
 	if err != nil {
-		m := fmt.Sprintf("Failed to parse post object %v", err)
-		fmt.Println(m)
-		http.Error(w, m, http.StatusInternalServerError)
+		writeError(w, r, internalError("Failed to parse post object", err))
 		return
 	}
 
@@ -297,114 +566,132 @@ func handlerCluster(w http.ResponseWriter, r *http.Request) {
 /**
  *  Helper functions:
  */
-// Function that creates a table in ES for storing our data if table not already exists.
-func createIndexIfNotExist() {
-	client, err := elastic.NewClient(elastic.SetURL(ES_URL), elastic.SetSniff(false))
-	if err != nil {
-		panic(err)
-	}
+// Function that helps save a post to ElasticSearch on GCE (Google Compute Engine).
+func saveToES(ctx context.Context, client *elastic.Client, post *Post, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
 
-	// Create "post" index into ES to store users' posts.
-	exists, err := client.IndexExists(POST_INDEX).Do(context.Background())
+	_, err := client.Index().
+		Index(POST_INDEX).
+		Type(POST_TYPE).
+		Id(id).
+		BodyJson(post).
+		Refresh("wait_for").
+		Do(ctx)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	if !exists {
-		mapping := `{
-            "mappings": {
-                "post": {
-                    "properties": {
-                        "location": {
-                            "type": "geo_point"
-                        }
-                    }
-                }
-            }
-        }`
-		_, err = client.CreateIndex(POST_INDEX).Body(mapping).Do(context.Background())
-		if err != nil {
-			panic(err)
-		}
-	}
+	fmt.Printf("Post is saved to index: %s\n", post.Message)
+	return nil
+}
 
-	// Create "user" index into ES for storing user info.
-	exists, err = client.IndexExists(USER_INDEX).Do(context.Background())
-	if err != nil {
-		panic(err)
-	}
+// Function that removes a post from ElasticSearch, when it is deleted or could not be created.
+func deleteFromES(ctx context.Context, client *elastic.Client, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
 
-	if !exists {
-		_, err = client.CreateIndex(USER_INDEX).Do(context.Background())
-		if err != nil {
-			panic(err)
-		}
+	_, err := client.Delete().
+		Index(POST_INDEX).
+		Type(POST_TYPE).
+		Id(id).
+		Refresh("wait_for").
+		Do(ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		return err
 	}
 
+	fmt.Printf("Post is deleted from index: %s\n", id)
+	return nil
 }
 
-// Function that helps save a post to Google BigTable for later transmitting data to BigQuery for offline analysis.
-func saveToBigTable(p *Post, id string) {
-	ctx := context.Background()
-	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE, option.WithCredentialsFile(CREDENTIAL_FILE))
+// Function that reads one post from ElasticSearch by its id.
+func readPostFromES(ctx context.Context, client *elastic.Client, id string) (*Post, error) {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	res, err := client.Get().
+		Index(POST_INDEX).
+		Type(POST_TYPE).
+		Id(id).
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
 	if err != nil {
-		panic(err)
-		return
+		return nil, err
 	}
 
-	tbl := bt_client.Open("post")
-	mut := bigtable.NewMutation()
-	t := bigtable.Now()
-	mut.Set("post", "user", t, []byte(p.User)) // cast to byte[] b/c BigTable stores data in byte array form.
-	mut.Set("post", "message", t, []byte(p.Message))
-	mut.Set("location", "lat", t, []byte(strconv.FormatFloat(p.Location.Lat, 'f', -1, 64)))
-	mut.Set("location", "lon", t, []byte(strconv.FormatFloat(p.Location.Lon, 'f', -1, 64)))
-
-	err = tbl.Apply(ctx, id, mut)
-	if err != nil {
-		panic(err)
-		return
+	var p Post
+	if err := json.Unmarshal(*res.Source, &p); err != nil {
+		return nil, err
 	}
-	fmt.Printf("Post is saved to BigTable: %s\n", p.Message)
+	return &p, nil
 }
 
-// Function that helps save a post to ElasticSearch on GCE (Google Compute Engine).
-func saveToES(post *Post, id string) error {
-	client, err := elastic.NewClient(elastic.SetURL(ES_URL), elastic.SetSniff(false))
-	if err != nil {
-		return err
-	}
+// Function that changes some fields of a stored post, e.g. {"face": 0.9}.
+func updatePostInES(ctx context.Context, client *elastic.Client, id string, fields map[string]interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
 
-	_, err = client.Index().
+	_, err := client.Update().
 		Index(POST_INDEX).
 		Type(POST_TYPE).
 		Id(id).
-		BodyJson(post).
+		Doc(fields).
 		Refresh("wait_for").
-		Do(context.Background())
-	if err != nil {
-		return err
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return ErrNotFound
 	}
+	return err
+}
 
-	fmt.Printf("Post is saved to index: %s\n", post.Message)
-	return nil
+// Function that runs a script updating a counter of a post, such as its number of reactions. What it
+// counts is already saved, so a failure is not reported to the caller; the outbox action repair recounts
+// the post instead.
+func updatePostCounter(ctx context.Context, client *elastic.Client, postId string, script *elastic.Script, repair string) {
+	err := runStep(ctx, repair, func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, esTimeout)
+		defer cancel()
+
+		_, err := client.Update().
+			Index(POST_INDEX).
+			Type(POST_TYPE).
+			Id(postId).
+			Script(script).
+			RetryOnConflict(3). // other users doing the same at the same time.
+			Do(ctx)
+		if elastic.IsNotFound(err) {
+			return ErrNotFound // the post was deleted meanwhile, nothing left to count.
+		}
+		return err
+	})
+	if err != nil && errors.Cause(err) != ErrNotFound {
+		fmt.Printf("Post %s: failed to update counter %v.\n", postId, err)
+		recordOutbox(OutboxEntry{PostId: postId, Action: repair, Error: err.Error()})
+	}
 }
 
 // Function that helps read the returned result from Elastic Search.
-func readFromES(lat, lon float64, ran string) ([]Post, error) {
-	client, err := elastic.NewClient(elastic.SetURL(ES_URL), elastic.SetSniff(false))
-	if err != nil {
-		return nil, err
-	}
+// With sort set to SORT_ENGAGEMENT the posts with the most reactions and comments come first, otherwise the order is
+// up to ES.
+func readFromES(ctx context.Context, client *elastic.Client, lat, lon float64, ran, sort string) ([]Post, error) {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
 
 	query := elastic.NewGeoDistanceQuery("location")
 	query = query.Distance(ran).Lat(lat).Lon(lon)
 
-	searchResult, err := client.Search().
+	search := client.Search().
 		Index(POST_INDEX).
 		Query(query).
-		Pretty(true).
-		Do(context.Background())
+		Pretty(true)
+	if sort == SORT_ENGAGEMENT {
+		engagement := elastic.NewScript("doc['reaction_count'].value + doc['comment_count'].value")
+		search = search.SortBy(elastic.NewScriptSort(engagement, "number").Desc(), elastic.NewFieldSort("created").Desc())
+	}
+	searchResult, err := search.Do(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -430,8 +717,9 @@ func readFromES(lat, lon float64, ran string) ([]Post, error) {
 
 // Function that helps save the image of a post to GCS (Google Cloud Storage).
 // It will return the MediaLink (url) of the saved image.
-func saveToGCS(r io.Reader, bucketName, objectName string) (*storage.ObjectAttrs, error) {
-	ctx := context.Background()
+func saveToGCS(ctx context.Context, r io.Reader, bucketName, objectName string) (*storage.ObjectAttrs, error) {
+	ctx, cancel := context.WithTimeout(ctx, gcsTimeout)
+	defer cancel()
 
 	//client, err := storage.NewClient(ctx）
 
@@ -457,14 +745,63 @@ func saveToGCS(r io.Reader, bucketName, objectName string) (*storage.ObjectAttrs
 
 	// Grant access to the bucket to everyone on the Internet (for downloading images).
 	if err = object.ACL().Set(ctx, storage.AllUsers, storage.RoleReader); err != nil {
+		removeUploadedObject(bucketName, objectName)
 		return nil, err
 	}
 
 	attrs, err := object.Attrs(ctx)
 	if err != nil {
+		removeUploadedObject(bucketName, objectName)
 		return nil, err
 	}
 
 	fmt.Printf("Image is saved to GCS: %s\n", attrs.MediaLink)
 	return attrs, nil
 }
+
+// Function that downloads the image of a post from GCS.
+func readFromGCS(ctx context.Context, bucketName, objectName string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, gcsTimeout)
+	defer cancel()
+
+	client, err := storage.NewClient(ctx, option.WithCredentialsFile(CREDENTIAL_FILE))
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := client.Bucket(bucketName).Object(objectName).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// Function that removes an image from GCS, used to roll back a post that could not be created.
+func deleteFromGCS(ctx context.Context, bucketName, objectName string) error {
+	ctx, cancel := context.WithTimeout(ctx, gcsTimeout)
+	defer cancel()
+
+	client, err := storage.NewClient(ctx, option.WithCredentialsFile(CREDENTIAL_FILE))
+	if err != nil {
+		return err
+	}
+
+	if err := client.Bucket(bucketName).Object(objectName).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+		return err
+	}
+	fmt.Printf("Image is deleted from GCS: %s\n", objectName)
+	return nil
+}
+
+// An upload that fails halfway leaves an object nobody will ever refer to. It does not take the request
+// context: that is usually what expired, and the cleanup should still run.
+func removeUploadedObject(bucketName, objectName string) {
+	if err := deleteFromGCS(context.Background(), bucketName, objectName); err != nil {
+		fmt.Printf("Failed to delete half uploaded image %s from GCS %v.\n", objectName, err)
+		recordOutbox(OutboxEntry{PostId: objectName, Action: "gcs.delete", Error: err.Error()})
+	}
+}
@@ -46,8 +46,9 @@ var (
 )
 
 // Annotate a image file based on ml model, return score and error if exists.
-func annotate(r io.Reader) (float64, error) {
-	ctx := context.Background()
+func annotate(ctx context.Context, r io.Reader) (float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, mlTimeout)
+	defer cancel()
 	buf, _ := ioutil.ReadAll(r)
 
 	ts, err := google.DefaultTokenSource(ctx, scope)
@@ -71,6 +72,7 @@ func annotate(r io.Reader) (float64, error) {
 	body, _ := json.Marshal(request)
 	// Construct a http request.
 	req, _ := http.NewRequest("POST", url, strings.NewReader(string(body)))
+	req = req.WithContext(ctx) // give up when the client leaves or ML Engine is too slow.
 	req.Header.Set("Authorization", "Bearer "+tt.AccessToken)
 
 	fmt.Printf("Sending request to ml engine for prediction %s with token as %s\n", url, tt.AccessToken)
@@ -81,6 +83,7 @@ func annotate(r io.Reader) (float64, error) {
 		fmt.Printf("failed to send ml request %v\n", err)
 		return 0.0, err
 	}
+	defer res.Body.Close()
 	var resp MlResponse
 	body, _ = ioutil.ReadAll(res.Body)
 
@@ -0,0 +1,321 @@
+package main
+
+// This module is the inbox of the notifications saved areas produce (see alert.go):
+//
+//	GET   /api/v1/notifications        your notifications, newest first (?unread=true for the unread ones)
+//	PATCH /api/v1/notifications/{id}   mark one read or unread with {"read": true}
+//
+// Lists page like the feed (?limit=, ?cursor=) and carry the number of unread notifications. Besides the
+// inbox, every new notification is handed to a Notifier picked with NOTIFIER: "log" (the default) prints
+// it, "webhook" posts it as JSON to NOTIFY_WEBHOOK_URL and "off" does nothing. The inbox is the record,
+// a notifier that fails is not retried.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/olivere/elastic"
+	"github.com/pkg/errors"
+)
+
+const (
+	NOTIFICATION_INDEX = "notification"
+	NOTIFICATION_TYPE  = "notification"
+)
+
+var (
+	notifierKind     = envString("NOTIFIER", "log")
+	notifyWebhookUrl = envString("NOTIFY_WEBHOOK_URL", "")
+	notifyTimeout    = envDuration("NOTIFY_TIMEOUT", 5*time.Second)
+)
+
+var (
+	notificationsSent   = expvar.NewInt("notifications_sent")
+	notificationsFailed = expvar.NewInt("notifications_failed")
+)
+
+// Notification tells a user about a post in one of their saved areas.
+type Notification struct {
+	Id       string    `json:"id"` // area id:post id, so a post notifies once per area.
+	User     string    `json:"user"`
+	AreaId   string    `json:"area_id"`
+	AreaName string    `json:"area_name"`
+	PostId   string    `json:"post_id"`
+	Post     *Post     `json:"post"` // the post when it was notified.
+	Created  time.Time `json:"created"`
+	Read     bool      `json:"read"`
+}
+
+// NotificationPage is one page of the inbox.
+type NotificationPage struct {
+	Notifications []Notification `json:"notifications"`
+	Unread        int64          `json:"unread"`
+	NextCursor    string         `json:"next_cursor,omitempty"`
+}
+
+// Notifier delivers notifications outside of the inbox.
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// The notifier of this process, set up in main.
+var notifier Notifier = LogNotifier{}
+
+// Function that creates the notifier named by kind.
+func newNotifier(kind string) (Notifier, error) {
+	switch kind {
+	case "off":
+		return nil, nil
+	case "log":
+		return LogNotifier{}, nil
+	case "webhook":
+		if notifyWebhookUrl == "" {
+			return nil, errors.New("NOTIFIER=webhook needs NOTIFY_WEBHOOK_URL")
+		}
+		return &WebhookNotifier{url: notifyWebhookUrl, client: &http.Client{Timeout: notifyTimeout}}, nil
+	default:
+		return nil, fmt.Errorf("unknown notifier %q", kind)
+	}
+}
+
+// LogNotifier prints notifications, for local runs.
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(ctx context.Context, n Notification) error {
+	fmt.Printf("Notify %s: post %s in %q\n", n.User, n.PostId, n.AreaName)
+	return nil
+}
+
+// WebhookNotifier posts each notification as JSON to a url.
+type WebhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (w *WebhookNotifier) Notify(ctx context.Context, n Notification) error {
+	js, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(js))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %s", res.Status)
+	}
+	return nil
+}
+
+// Handler for GET /notifications.
+func handlerNotifications(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
+
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	query := r.URL.Query()
+	var v ValidationError
+	limit := v.Limit("limit", query.Get("limit"))
+	after := v.Cursor("cursor", query.Get("cursor"))
+	unreadOnly := false
+	if val := query.Get("unread"); val != "" {
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			v.Add("unread", "must be true or false")
+		}
+		unreadOnly = b
+	}
+	if err := v.Err(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	page, err := listNotifications(r.Context(), esClient, getUsername(r), unreadOnly, after, limit)
+	if err != nil {
+		writeError(w, r, internalError("Failed to read notifications from ElasticSearch", err))
+		return
+	}
+	js, err := json.Marshal(page)
+	if err != nil {
+		writeError(w, r, internalError("Failed to parse notifications into JSON format", err))
+		return
+	}
+	w.Write(js)
+}
+
+// Handler for PATCH /notifications/{id}.
+func handlerNotification(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
+	w.Header().Set("Access-Control-Allow-Methods", "PATCH")
+
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	var update struct {
+		Read *bool `json:"read"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, r, badRequest("invalid_json", "Failed to parse JSON input from client", err))
+		return
+	}
+	if update.Read == nil {
+		var v ValidationError
+		v.Add("read", "is required")
+		writeError(w, r, v.Err())
+		return
+	}
+
+	n, err := markNotification(r.Context(), esClient, mux.Vars(r)["id"], getUsername(r), *update.Read)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	js, err := json.Marshal(n)
+	if err != nil {
+		writeError(w, r, internalError("Failed to parse notification into JSON format", err))
+		return
+	}
+	w.Write(js)
+}
+
+/**
+ *  Helper functions:
+ */
+// Function that records a notification of a post in a saved area and hands it to the notifier. A post
+// that was already notified for this area is skipped.
+func addNotification(ctx context.Context, client *elastic.Client, a *SavedArea, p *Post) error {
+	n := Notification{
+		Id:       a.Id + ":" + p.Id,
+		User:     a.User,
+		AreaId:   a.Id,
+		AreaName: a.Name,
+		PostId:   p.Id,
+		Post:     p,
+		Created:  time.Now(),
+	}
+
+	indexCtx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+	_, err := client.Index().
+		Index(NOTIFICATION_INDEX).
+		Type(NOTIFICATION_TYPE).
+		Id(n.Id).
+		OpType("create").
+		BodyJson(n).
+		Do(indexCtx)
+	if elastic.IsConflict(err) {
+		return nil // notified before the step was retried.
+	}
+	if err != nil {
+		return err
+	}
+
+	if notifier == nil {
+		return nil
+	}
+	notifyCtx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+	if err := notifier.Notify(notifyCtx, n); err != nil {
+		notificationsFailed.Add(1)
+		fmt.Printf("Failed to notify %s of post %s %v.\n", n.User, n.PostId, err)
+		return nil
+	}
+	notificationsSent.Add(1)
+	return nil
+}
+
+// Function that reads one page of the inbox of a user, newest first, with the number of unread
+// notifications.
+func listNotifications(ctx context.Context, client *elastic.Client, user string, unreadOnly bool, after []interface{}, limit int) (*NotificationPage, error) {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	unread := elastic.NewBoolQuery().Filter(elastic.NewTermQuery("user", user), elastic.NewTermQuery("read", false))
+	query := elastic.Query(elastic.NewTermQuery("user", user))
+	if unreadOnly {
+		query = unread
+	}
+	search := client.Search().
+		Index(NOTIFICATION_INDEX).
+		Query(query).
+		SortBy(elastic.NewFieldSort("created").Desc(), elastic.NewFieldSort("id").Asc()).
+		Size(limit)
+	if after != nil {
+		search = search.SearchAfter(after...)
+	}
+	searchResult, err := search.Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	count, err := client.Count(NOTIFICATION_INDEX).Query(unread).Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &NotificationPage{Notifications: make([]Notification, 0, len(searchResult.Hits.Hits)), Unread: count}
+	for _, hit := range searchResult.Hits.Hits {
+		var n Notification
+		if err := json.Unmarshal(*hit.Source, &n); err != nil {
+			return nil, errors.Wrapf(err, "notification %s", hit.Id)
+		}
+		page.Notifications = append(page.Notifications, n)
+	}
+	if next := nextPage(searchResult, limit); next != nil {
+		page.NextCursor = encodeCursor(next)
+	}
+	return page, nil
+}
+
+// Function that marks a notification of user read or unread and returns it.
+func markNotification(ctx context.Context, client *elastic.Client, id, user string, read bool) (*Notification, error) {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	res, err := client.Get().Index(NOTIFICATION_INDEX).Type(NOTIFICATION_TYPE).Id(id).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var n Notification
+	if err := json.Unmarshal(*res.Source, &n); err != nil {
+		return nil, err
+	}
+	if n.User != user {
+		return nil, ErrNotFound // other users' notifications do not exist as far as you know.
+	}
+
+	_, err = client.Update().
+		Index(NOTIFICATION_INDEX).
+		Type(NOTIFICATION_TYPE).
+		Id(id).
+		Doc(map[string]interface{}{"read": read}).
+		Refresh("wait_for").
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	n.Read = read
+	return &n, nil
+}
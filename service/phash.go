@@ -0,0 +1,268 @@
+package main
+
+// This module detects re-posted images. Every image gets a perceptual hash (dHash) which stays the same,
+// or nearly the same, when the picture is re-encoded, resized or slightly edited, so two hashes that differ
+// in only a few bits point at the same photo.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/gif" // register decoders for image.Decode.
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/olivere/elastic"
+)
+
+const (
+	DUPLICATE_OFF    = "off"    // do not check for duplicates.
+	DUPLICATE_FLAG   = "flag"   // save the post but mark it as a duplicate of the earlier one.
+	DUPLICATE_REJECT = "reject" // refuse to save the post.
+
+	DUPLICATE_SCAN        = 500  // max number of recent posts of a user compared against a new image.
+	DUPLICATE_CLUSTER_MAX = 5000 // max number of posts /admin/duplicates compares, newest first.
+)
+
+var (
+	// What to do when a user re-posts the same image, DUPLICATE_OFF, DUPLICATE_FLAG or DUPLICATE_REJECT.
+	// Anything else flags.
+	duplicatePolicy = envString("DUPLICATE_POLICY", DUPLICATE_FLAG)
+	// How far back to look for an earlier post of the same user.
+	duplicateWindow = envDuration("DUPLICATE_WINDOW", 24*time.Hour)
+	// Max number of differing bits for two hashes to be near-duplicates.
+	duplicateDistance = envInt("DUPLICATE_DISTANCE", 10)
+	// How far back /admin/duplicates looks for clusters.
+	duplicateClusterWindow = envDuration("DUPLICATE_CLUSTER_WINDOW", 30*24*time.Hour)
+)
+
+// DuplicateEntry is a post that belongs to a cluster of near-duplicate images.
+type DuplicateEntry struct {
+	Id string `json:"id"`
+	Post
+}
+
+// Compute a 64-bit difference hash of an image. The image is shrunk to 9x8 grayscale cells and each bit
+// records whether a cell is darker than its right neighbour.
+func dHash(r io.Reader) (uint64, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return 0, err
+	}
+
+	b := img.Bounds()
+	if b.Dx() < 9 || b.Dy() < 8 {
+		return 0, fmt.Errorf("image is too small to hash: %dx%d", b.Dx(), b.Dy())
+	}
+
+	var gray [8][9]float64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 9; x++ {
+			cell := image.Rect(
+				b.Min.X+x*b.Dx()/9, b.Min.Y+y*b.Dy()/8,
+				b.Min.X+(x+1)*b.Dx()/9, b.Min.Y+(y+1)*b.Dy()/8,
+			)
+			gray[y][x] = averageLuma(img, cell)
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if gray[y][x] < gray[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash, nil
+}
+
+// Average brightness of all pixels of an image inside a rectangle.
+func averageLuma(img image.Image, rect image.Rectangle) float64 {
+	var sum float64
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+		}
+	}
+	return sum / float64(rect.Dx()*rect.Dy())
+}
+
+// Number of bits two hashes differ in.
+func hammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// Hashes are stored on the post as 16 hex digits.
+func formatHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+func parseHash(s string) (uint64, error) {
+	return strconv.ParseUint(s, 16, 64)
+}
+
+// Function that looks for a post of the same user within duplicateWindow whose image is a near-duplicate
+// of hash. It returns the id of the most recent such post, or an empty string if there is none.
+func findDuplicate(ctx context.Context, client *elastic.Client, user string, hash uint64) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	query := elastic.NewBoolQuery().Filter(
+		elastic.NewTermQuery("user", user),
+		elastic.NewExistsQuery("hash"),
+		elastic.NewRangeQuery("created").Gte(time.Now().Add(-duplicateWindow)),
+	)
+
+	searchResult, err := client.Search().
+		Index(POST_INDEX).
+		Query(query).
+		Sort("created", false). // the most recent posts when there are more than DUPLICATE_SCAN.
+		Size(DUPLICATE_SCAN).
+		Do(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	for _, hit := range searchResult.Hits.Hits {
+		var p Post
+		if err := json.Unmarshal(*hit.Source, &p); err != nil {
+			continue
+		}
+		if h, err := parseHash(p.Hash); err == nil && hammingDistance(h, hash) <= duplicateDistance {
+			return hit.Id, nil
+		}
+	}
+	return "", nil
+}
+
+// Function that groups the hashed posts created since since into clusters of near-duplicate images.
+// Every pair is compared, so only the newest DUPLICATE_CLUSTER_MAX of them are. Posts without any
+// near-duplicate are left out.
+func findDuplicateClusters(ctx context.Context, client *elastic.Client, distance int, since time.Time) ([][]DuplicateEntry, error) {
+	var entries []DuplicateEntry
+	var hashes []uint64
+	query := elastic.NewBoolQuery().Filter(
+		elastic.NewExistsQuery("hash"),
+		elastic.NewRangeQuery("created").Gte(since),
+	)
+	scroll := client.Scroll(POST_INDEX).Query(query).Sort("created", false).Size(500)
+	defer scroll.Clear(context.Background())
+	for len(entries) < DUPLICATE_CLUSTER_MAX {
+		// Each page gets its own deadline, the whole scan may legitimately take longer than one call.
+		pageCtx, cancel := context.WithTimeout(ctx, esTimeout)
+		searchResult, err := scroll.Do(pageCtx)
+		cancel()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, hit := range searchResult.Hits.Hits {
+			var p Post
+			if err := json.Unmarshal(*hit.Source, &p); err != nil {
+				continue
+			}
+			h, err := parseHash(p.Hash)
+			if err != nil || len(entries) == DUPLICATE_CLUSTER_MAX {
+				continue
+			}
+			entries = append(entries, DuplicateEntry{Id: hit.Id, Post: p})
+			hashes = append(hashes, h)
+		}
+	}
+
+	// Union-find over every pair of hashes. Near-duplicate is not transitive, so a cluster may contain
+	// two images further apart than distance as long as a chain of close images connects them.
+	parent := make([]int, len(hashes))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for i := range hashes {
+		for j := i + 1; j < len(hashes); j++ {
+			if hammingDistance(hashes[i], hashes[j]) <= distance {
+				parent[find(i)] = find(j)
+			}
+		}
+	}
+
+	groups := make(map[int][]DuplicateEntry)
+	var roots []int
+	for i, e := range entries {
+		root := find(i)
+		if _, ok := groups[root]; !ok {
+			roots = append(roots, root)
+		}
+		groups[root] = append(groups[root], e)
+	}
+
+	var clusters [][]DuplicateEntry
+	for _, root := range roots {
+		if len(groups[root]) > 1 {
+			clusters = append(clusters, groups[root])
+		}
+	}
+	return clusters, nil
+}
+
+// Handler GET request sent to /admin/duplicates (find clusters of near-duplicate images among the posts of
+// the last duplicateClusterWindow).
+func handlerDuplicates(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
+
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	fmt.Println("Received one duplicates request")
+
+	if !isAdmin(getUsername(r)) {
+		writeError(w, r, ErrForbidden)
+		return
+	}
+
+	// distance is optional.
+	distance := duplicateDistance
+	if val := r.URL.Query().Get("distance"); val != "" {
+		d, err := strconv.Atoi(val)
+		if err != nil || d < 0 || d > 64 {
+			var v ValidationError
+			v.Add("distance", "must be a whole number between 0 and 64")
+			writeError(w, r, v.Err())
+			return
+		}
+		distance = d
+	}
+
+	clusters, err := findDuplicateClusters(r.Context(), esClient, distance, time.Now().Add(-duplicateClusterWindow))
+	if err != nil {
+		writeError(w, r, internalError("Failed to read posts from ElasticSearch", err))
+		return
+	}
+
+	js, err := json.Marshal(clusters)
+	if err != nil {
+		writeError(w, r, internalError("Failed to parse clusters into JSON format", err))
+		return
+	}
+
+	w.Write(js)
+}
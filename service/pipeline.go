@@ -0,0 +1,331 @@
+package main
+
+// This module creates a post as a saga: a list of steps that each succeed, are retried, or get undone.
+// When a step keeps failing it is undone itself, since its write may have landed before the error (an
+// ElasticSearch timeout, say), then every step before it is compensated in reverse order, so a failed
+// post leaves no public image or half-written document behind. Anything that cannot be fixed right away,
+// such as a compensation that fails, goes to the outbox, a JSONL file that repairOutbox works through in
+// the background.
+//
+// The outbox is a file on the local disk of the instance. On App Engine flex that disk goes away with
+// the instance, when it is replaced or scaled down, and the entries that were still in it go with it:
+// point OUTBOX_FILE at a persistent disk where there is one. Otherwise what the log says about failed
+// repairs ("Failed to undo step", "repair ... failed again") is all that is left to clean up by hand.
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	STEP_RETRIES           = 2                      // extra attempts for a failing step before giving up.
+	STEP_BACKOFF           = 200 * time.Millisecond // wait before the first retry, doubled for each next one.
+	COMPENSATION_TIMEOUT   = 30 * time.Second       // time to undo the completed steps of a failed post.
+	OUTBOX_REPAIR_INTERVAL = time.Minute            // how often the outbox is worked through.
+	OUTBOX_REPAIR_TIMEOUT  = 5 * time.Minute        // time one round of repairs may take at most.
+)
+
+// Where failed steps are recorded, it must survive restarts of the service. It is local to the instance,
+// see above.
+var outboxFile = envString("OUTBOX_FILE", "outbox.jsonl")
+
+// step is one stage of creating a post.
+type step struct {
+	name string
+	run  func(ctx context.Context) error
+	// Reverts run, nil if there is nothing to revert. It also runs after run failed, so it must do no
+	// harm when run had no effect.
+	undo func(ctx context.Context) error
+
+	// Outbox action (see repairActions) that finishes the undo later if it keeps failing.
+	repair string
+}
+
+// Function that runs the steps creating post p with the given id. On failure it returns the error of
+// the step that failed, after undoing it and every completed step.
+func runSaga(ctx context.Context, id string, p *Post, steps []step) error {
+	var done []step
+	for _, s := range steps {
+		// A step that failed is undone too: it may have failed after its write landed.
+		done = append(done, s)
+		err := runStep(ctx, s.name, s.run)
+		if err == nil {
+			continue
+		}
+
+		fmt.Printf("Post %s: step %s failed, rolling back %v.\n", id, s.name, err)
+		compensate(id, p, done)
+		return err
+	}
+	return nil
+}
+
+// Undo the steps that were run in reverse order. It does not use the request context: that is usually what
+// expired, and the cleanup should still run.
+func compensate(id string, p *Post, done []step) {
+	ctx, cancel := context.WithTimeout(context.Background(), COMPENSATION_TIMEOUT)
+	defer cancel()
+
+	for i := len(done) - 1; i >= 0; i-- {
+		s := done[i]
+		if s.undo == nil {
+			continue
+		}
+		if err := runStep(ctx, "undo "+s.name, s.undo); err != nil {
+			fmt.Printf("Post %s: failed to undo step %s %v.\n", id, s.name, err)
+			recordOutbox(OutboxEntry{PostId: id, Action: s.repair, Post: p, Error: err.Error()})
+		}
+	}
+}
+
+// Run f, retrying with exponential backoff until it succeeds, fails permanently, runs out of attempts
+// or ctx is done. A panic in f is turned into an error instead of crashing the service.
+func runStep(ctx context.Context, name string, f func(ctx context.Context) error) error {
+	backoff := STEP_BACKOFF
+	for attempt := 0; ; attempt++ {
+		err := safeRun(ctx, f)
+		if err == nil || attempt == STEP_RETRIES || isPermanent(err) {
+			return err
+		}
+
+		fmt.Printf("Step %s failed, retrying in %v %v.\n", name, backoff, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func safeRun(ctx context.Context, f func(ctx context.Context) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return f(ctx)
+}
+
+// Errors that will not go away by trying again: the client's fault, or a known condition of the store.
+func isPermanent(err error) bool {
+	switch cause := errors.Cause(err).(type) {
+	case *ValidationError:
+		return true
+	case *HTTPError:
+		return cause.Status < 500
+	default:
+		_, ok := sentinelErrors[cause]
+		return ok
+	}
+}
+
+// OutboxEntry is a step that failed and still has to be done.
+type OutboxEntry struct {
+	PostId   string    `json:"post_id"`
+	Action   string    `json:"action"`
+	Post     *Post     `json:"post,omitempty"`
+	Error    string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	Time     time.Time `json:"time"`
+}
+
+// What each outbox action does to repair a post.
+var repairActions = map[string]func(ctx context.Context, e OutboxEntry) error{
+	"gcs.delete": func(ctx context.Context, e OutboxEntry) error {
+		return deleteFromGCS(ctx, BUCKET_NAME, e.PostId)
+	},
+	"es.delete": func(ctx context.Context, e OutboxEntry) error {
+		return deleteFromES(ctx, esClient, e.PostId)
+	},
+	"reactions.recount": func(ctx context.Context, e OutboxEntry) error {
+		err := recountReactions(ctx, esClient, e.PostId)
+		if errors.Cause(err) == ErrNotFound {
+			return nil // the post is gone, so are its counters.
+		}
+		return err
+	},
+	"reactions.delete": func(ctx context.Context, e OutboxEntry) error {
+		return deleteReactions(ctx, esClient, e.PostId)
+	},
+	"comments.recount": func(ctx context.Context, e OutboxEntry) error {
+		err := recountComments(ctx, esClient, e.PostId)
+		if errors.Cause(err) == ErrNotFound {
+			return nil
+		}
+		return err
+	},
+	"comments.delete": func(ctx context.Context, e OutboxEntry) error {
+		return deleteComments(ctx, esClient, e.PostId)
+	},
+	"alerts.match": func(ctx context.Context, e OutboxEntry) error {
+		if e.Post == nil {
+			return errors.New("outbox entry has no post")
+		}
+		return matchAlerts(ctx, esClient, e.Post)
+	},
+	"webhooks.created": func(ctx context.Context, e OutboxEntry) error {
+		if e.Post == nil {
+			return errors.New("outbox entry has no post")
+		}
+		return webhooks.record(ctx, esClient, PostEvent{Id: e.PostId, Type: POST_CREATED, Post: e.Post, Time: e.Post.Created})
+	},
+	"webhooks.deleted": func(ctx context.Context, e OutboxEntry) error {
+		if e.Post == nil {
+			return errors.New("outbox entry has no post")
+		}
+		return webhooks.record(ctx, esClient, PostEvent{Id: e.PostId, Type: POST_DELETED, Post: e.Post, Time: e.Time})
+	},
+	"analytics.write": func(ctx context.Context, e OutboxEntry) error {
+		if analytics == nil {
+			return errors.New("analytics is turned off")
+		}
+		if e.Post == nil {
+			return errors.New("outbox entry has no post")
+		}
+		return analytics.sink.Write(ctx, []PostEvent{{Id: e.PostId, Type: POST_CREATED, Post: e.Post, Time: e.Post.Created}})
+	},
+}
+
+var outboxMu sync.Mutex
+
+// Append an entry to the outbox and flush it to disk.
+func recordOutbox(e OutboxEntry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	outboxMu.Lock()
+	defer outboxMu.Unlock()
+
+	if err := appendOutbox(outboxFile, e); err != nil {
+		// Last resort, at least the log has everything needed to repair the post by hand.
+		js, _ := json.Marshal(e)
+		fmt.Printf("Failed to write to outbox %v: %s\n", err, js)
+	}
+}
+
+func appendOutbox(name string, entries ...OutboxEntry) error {
+	var lines []byte
+	for _, e := range entries {
+		js, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, js...)
+		lines = append(lines, '\n')
+	}
+
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(lines); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Function that tries every outbox entry once more and keeps only those that still fail. The repairs go
+// over the network and are retried, so they run without outboxMu and within OUTBOX_REPAIR_TIMEOUT: the
+// outbox is first moved aside to a working file, recordOutbox starts a new one meanwhile, and the entries
+// that still fail are appended back to it at the end. A working file left by a crash is picked up by the
+// next round, whose repairs then run twice at worst, which they all allow.
+func repairOutbox(ctx context.Context) error {
+	working := outboxFile + ".repairing"
+
+	outboxMu.Lock()
+	if _, err := os.Stat(working); os.IsNotExist(err) {
+		err = os.Rename(outboxFile, working)
+		if os.IsNotExist(err) {
+			outboxMu.Unlock()
+			return nil
+		}
+		if err != nil {
+			outboxMu.Unlock()
+			return err
+		}
+	}
+	outboxMu.Unlock()
+
+	entries, err := readOutbox(working)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, OUTBOX_REPAIR_TIMEOUT)
+	defer cancel()
+
+	var remaining []OutboxEntry
+	for _, e := range entries {
+		action, ok := repairActions[e.Action]
+		switch {
+		case !ok:
+			fmt.Printf("Post %s: unknown outbox action %s, keeping it.\n", e.PostId, e.Action)
+		case ctx.Err() != nil:
+			// Out of time, the entry waits for the next round as it is.
+		default:
+			err := runStep(ctx, e.Action, func(ctx context.Context) error { return action(ctx, e) })
+			if err == nil {
+				fmt.Printf("Post %s: repaired %s.\n", e.PostId, e.Action)
+				continue
+			}
+			e.Attempts++
+			e.Error = err.Error()
+			fmt.Printf("Post %s: repair %s failed again %v.\n", e.PostId, e.Action, err)
+		}
+		remaining = append(remaining, e)
+	}
+
+	outboxMu.Lock()
+	defer outboxMu.Unlock()
+
+	if len(remaining) > 0 {
+		if err := appendOutbox(outboxFile, remaining...); err != nil {
+			return err // the working file is still there, the next round tries all of it again.
+		}
+	}
+	return os.Remove(working)
+}
+
+// Function that reads the entries of an outbox file.
+func readOutbox(name string) ([]OutboxEntry, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []OutboxEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024) // a post with a long message makes for a long line.
+	for scanner.Scan() {
+		var e OutboxEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			fmt.Printf("Dropping unreadable outbox entry %q.\n", scanner.Text())
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// Work through the outbox every OUTBOX_REPAIR_INTERVAL for as long as the service runs.
+func startOutboxRepair() {
+	go func() {
+		for range time.Tick(OUTBOX_REPAIR_INTERVAL) {
+			if err := repairOutbox(context.Background()); err != nil {
+				fmt.Printf("Failed to repair outbox %v.\n", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,229 @@
+package main
+
+// This module serves user profiles:
+//
+//	GET   /api/v1/users/{username}   profile of any user
+//	PATCH /api/v1/users/{username}   change your own profile (admins may change any)
+//	GET   /api/v1/me                 your own profile, including your privacy settings
+//	PATCH /api/v1/me
+//
+// A PATCH body is JSON with the fields to change. To upload an avatar, send multipart/form-data instead,
+// with the image in "avatar" and the JSON in an optional "profile" field. Responses are always a Profile,
+// which has no credential fields at all.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pborman/uuid"
+)
+
+const (
+	MAX_DISPLAY_NAME_LENGTH = 50
+	MAX_BIO_LENGTH          = 500
+	MAX_GENDER_LENGTH       = 20
+	MAX_AVATAR_SIZE         = 5 << 20    // bytes in a PATCH request, avatar included.
+	AVATAR_PREFIX           = "avatars/" // GCS objects of avatars are <prefix><username>/<uuid>.
+)
+
+// Privacy is what a user shares with other users.
+type Privacy struct {
+	Private    bool `json:"private"` // others only see the username, display name and avatar.
+	HideAge    bool `json:"hide_age"`
+	HideGender bool `json:"hide_gender"`
+}
+
+// Profile is a user as shown to clients.
+type Profile struct {
+	Username    string    `json:"username"`
+	DisplayName string    `json:"display_name,omitempty"`
+	AvatarUrl   string    `json:"avatar_url,omitempty"`
+	Bio         string    `json:"bio,omitempty"`
+	Age         int64     `json:"age,omitempty"`
+	Gender      string    `json:"gender,omitempty"`
+	Created     time.Time `json:"created"`
+	Privacy     *Privacy  `json:"privacy,omitempty"` // only shown to the user themselves.
+}
+
+// ProfileUpdate is the body of a PATCH request, fields that are left out keep their value.
+type ProfileUpdate struct {
+	DisplayName *string  `json:"display_name"`
+	Bio         *string  `json:"bio"`
+	Age         *int64   `json:"age"`
+	Gender      *string  `json:"gender"`
+	Privacy     *Privacy `json:"privacy"`
+}
+
+// The profile of u as seen by the user viewer, leaving out what u does not share.
+func (u *User) profile(viewer string) Profile {
+	p := Profile{
+		Username:    u.Username,
+		DisplayName: u.DisplayName,
+		AvatarUrl:   u.AvatarUrl,
+		Created:     u.Created,
+	}
+	self := viewer == u.Username || isAdmin(viewer)
+	if self {
+		privacy := u.Privacy
+		p.Privacy = &privacy
+	}
+	if self || !u.Privacy.Private {
+		p.Bio = u.Bio
+		if self || !u.Privacy.HideAge {
+			p.Age = u.Age
+		}
+		if self || !u.Privacy.HideGender {
+			p.Gender = u.Gender
+		}
+	}
+	return p
+}
+
+// Handler for /users/{username} and /me.
+func handlerProfile(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
+	w.Header().Set("Access-Control-Allow-Methods", "GET,PATCH")
+
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	viewer := getUsername(r)
+	username := mux.Vars(r)["username"]
+	if username == "" {
+		username = viewer // /me
+	}
+
+	if r.Method == "PATCH" {
+		fmt.Printf("Received one profile update for %s\n", username)
+		if username != viewer && !isAdmin(viewer) {
+			writeError(w, r, ErrForbidden)
+			return
+		}
+	}
+
+	// A disabled user does not exist for anyone but admins, and their profile cannot be changed either.
+	user, err := userStore.Get(r.Context(), username)
+	if err == nil && user.Disabled && !isAdmin(viewer) {
+		err = ErrNotFound
+	}
+	if err == nil && r.Method == "PATCH" {
+		r.Body = http.MaxBytesReader(w, r.Body, MAX_AVATAR_SIZE) // bigger bodies fail to parse.
+		user, err = updateProfile(r, user)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	js, err := json.Marshal(user.profile(viewer))
+	if err != nil {
+		writeError(w, r, internalError("Failed to parse profile into JSON format", err))
+		return
+	}
+	w.Write(js)
+}
+
+// Apply the PATCH request r to the profile of user and return the updated user.
+func updateProfile(r *http.Request, user *User) (*User, error) {
+	username := user.Username
+	var update ProfileUpdate
+	var avatar multipart.File
+	var avatarName string
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(MAX_AVATAR_SIZE); err != nil {
+			return nil, badRequest("invalid_form", "Failed to parse the form", err)
+		}
+		file, header, err := r.FormFile("avatar")
+		if err != nil && err != http.ErrMissingFile {
+			return nil, badRequest("invalid_image", "Avatar is not available", err)
+		}
+		if file != nil {
+			defer file.Close()
+			avatar, avatarName = file, header.Filename
+		}
+		if js := r.FormValue("profile"); js != "" {
+			if err := json.Unmarshal([]byte(js), &update); err != nil {
+				return nil, badRequest("invalid_json", "Failed to parse JSON input from client", err)
+			}
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		return nil, badRequest("invalid_json", "Failed to parse JSON input from client", err)
+	}
+
+	var v ValidationError
+	fields := map[string]interface{}{}
+	if update.DisplayName != nil {
+		fields["display_name"] = v.Text("display_name", *update.DisplayName, MAX_DISPLAY_NAME_LENGTH)
+	}
+	if update.Bio != nil {
+		fields["bio"] = v.Text("bio", *update.Bio, MAX_BIO_LENGTH)
+	}
+	if update.Age != nil {
+		fields["age"] = v.Age("age", *update.Age)
+	}
+	if update.Gender != nil {
+		fields["gender"] = v.Text("gender", *update.Gender, MAX_GENDER_LENGTH)
+	}
+	if update.Privacy != nil {
+		fields["privacy"] = update.Privacy
+	}
+	if avatar != nil && mediaTypes[filepath.Ext(avatarName)] != "image" {
+		v.Add("avatar", "must be a jpeg, gif or png image")
+	}
+	if err := v.Err(); err != nil {
+		return nil, err
+	}
+
+	var object string
+	if avatar != nil {
+		var url string
+		var err error
+		object, url, err = saveAvatar(r.Context(), username, avatar)
+		if err != nil {
+			return nil, err
+		}
+		fields["avatar_url"] = url
+		fields["avatar_object"] = object
+	}
+	if len(fields) > 0 {
+		if err := userStore.Update(r.Context(), username, fields); err != nil {
+			if object != "" {
+				removeUploadedObject(BUCKET_NAME, object) // the profile still shows the previous avatar.
+			}
+			return nil, err
+		}
+	}
+	if object != "" && user.AvatarObject != "" {
+		removeOldAvatar(user.AvatarObject)
+	}
+	return userStore.Get(r.Context(), username)
+}
+
+// Function that stores a user's avatar in GCS and returns its object and url. Every upload is a new
+// object, the previous one stays in place until the profile points at the new one.
+func saveAvatar(ctx context.Context, username string, avatar multipart.File) (string, string, error) {
+	object := AVATAR_PREFIX + username + "/" + uuid.New()
+	attrs, err := saveToGCS(ctx, avatar, BUCKET_NAME, object)
+	if err != nil {
+		return "", "", internalError("Failed to save avatar to GCS", err)
+	}
+	return object, attrs.MediaLink, nil
+}
+
+// Function that deletes the avatar a user had before uploading a new one, so old avatars do not pile up.
+func removeOldAvatar(object string) {
+	if err := deleteFromGCS(context.Background(), BUCKET_NAME, object); err != nil {
+		fmt.Printf("Failed to delete old avatar %s from GCS %v.\n", object, err)
+		recordOutbox(OutboxEntry{PostId: object, Action: "gcs.delete", Error: err.Error()})
+	}
+}
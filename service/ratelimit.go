@@ -0,0 +1,461 @@
+package main
+
+// This module keeps clients from hammering the service. Routes wrapped with rateLimited draw from a token
+// bucket per client: the user of the JWT, or the client IP on routes without one. Each route has its own
+// limit, "<requests>/<period>" in an environment variable, e.g. RATE_LIMIT_POST=10/1m allows bursts of
+// 10 uploads and one more every 6 seconds, and "off" lifts it:
+//
+//	RATE_LIMIT_POST     /post                         10/1m
+//	RATE_LIMIT_COMMENT  POST /posts/{id}/comments     30/1m
+//	RATE_LIMIT_SEARCH   /search                       120/1m
+//	RATE_LIMIT_LOGIN    /login, per IP                20/1m
+//	RATE_LIMIT_SIGNUP   /signup, per IP               5/1h
+//
+// Answers carry RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset (seconds until the bucket is
+// full again), and a request over the limit is answered 429 "rate_limited" with Retry-After.
+//
+// On top of that, LOGIN_MAX_FAILURES wrong passwords for one username within LOGIN_FAILURE_WINDOW lock
+// it for LOGIN_LOCKOUT: every login is refused, even with the right password, with 429 "locked_out".
+// A successful login clears the failures.
+//
+// RATE_LIMITER picks where buckets and failures are counted: "memory" (the default) counts per instance,
+// "redis" counts at REDIS_URL for every instance together. When the counter is unavailable requests go
+// through. Client IPs are taken from X-Forwarded-For, skipping the PROXY_HOPS addresses appended by the
+// proxies in front of the service (1, the App Engine load balancer); with PROXY_HOPS=0 it is not trusted.
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const LIMITER_SWEEP = time.Minute // how often the memory limiter forgets idle clients.
+
+var (
+	rateLimiterKind = envString("RATE_LIMITER", "memory")
+	proxyHops       = envInt("PROXY_HOPS", 1)
+)
+
+// The limit of each rate limited route.
+var rateLimits = map[string]Limit{
+	"post":    envLimit("RATE_LIMIT_POST", Limit{Burst: 10, Per: time.Minute}),
+	"comment": envLimit("RATE_LIMIT_COMMENT", Limit{Burst: 30, Per: time.Minute}),
+	"search":  envLimit("RATE_LIMIT_SEARCH", Limit{Burst: 120, Per: time.Minute}),
+	"login":   envLimit("RATE_LIMIT_LOGIN", Limit{Burst: 20, Per: time.Minute}),
+	"signup":  envLimit("RATE_LIMIT_SIGNUP", Limit{Burst: 5, Per: time.Hour}),
+}
+
+var loginLockout = Lockout{
+	Max:      envInt("LOGIN_MAX_FAILURES", 5),
+	Window:   envDuration("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+	Duration: envDuration("LOGIN_LOCKOUT", 15*time.Minute),
+}
+
+var (
+	rateLimited429  = expvar.NewInt("rate_limited")
+	loginsLockedOut = expvar.NewInt("logins_locked_out")
+	rateLimitErrors = expvar.NewInt("rate_limit_errors")
+)
+
+// Limit allows bursts of Burst requests, and Burst more every Per. A zero Burst means no limit.
+type Limit struct {
+	Burst int
+	Per   time.Duration
+}
+
+// Tokens a bucket gains per second.
+func (l Limit) rate() float64 {
+	return float64(l.Burst) / l.Per.Seconds()
+}
+
+// Lockout locks a key for Duration once it failed Max times within Window.
+type Lockout struct {
+	Max      int
+	Window   time.Duration
+	Duration time.Duration
+}
+
+// LimitResult is the state of a bucket after a request drew from it.
+type LimitResult struct {
+	Allowed   bool
+	Remaining int
+	Reset     time.Duration // until the bucket is full again.
+	Retry     time.Duration // until the next request is allowed, 0 if it is already.
+}
+
+// Work out the result of drawing one token from a bucket that had tokens, elapsed ago.
+func (l Limit) take(tokens float64, elapsed time.Duration) (LimitResult, float64) {
+	tokens = math.Min(float64(l.Burst), tokens+elapsed.Seconds()*l.rate())
+	var res LimitResult
+	if tokens >= 1 {
+		tokens--
+		res.Allowed = true
+	} else {
+		res.Retry = seconds((1 - tokens) / l.rate())
+	}
+	res.Remaining = int(tokens)
+	res.Reset = seconds((float64(l.Burst) - tokens) / l.rate())
+	return res, tokens
+}
+
+// RateLimiter counts requests and login failures.
+type RateLimiter interface {
+	// Take draws one request from the bucket of key.
+	Take(ctx context.Context, key string, l Limit) (LimitResult, error)
+	// Fail records a failure of key, and returns how long key is locked for, 0 if it is not.
+	Fail(ctx context.Context, key string, l Lockout) (time.Duration, error)
+	// Locked returns how long key is still locked for, 0 if it is not.
+	Locked(ctx context.Context, key string) (time.Duration, error)
+	// Reset forgets the failures of key.
+	Reset(ctx context.Context, key string) error
+}
+
+// The limiter of this process, set up in main.
+var rateLimiter RateLimiter = NewMemoryLimiter()
+
+// Function that creates the limiter named by kind.
+func newRateLimiter(kind string) (RateLimiter, error) {
+	switch kind {
+	case "", "memory":
+		return NewMemoryLimiter(), nil
+	case "redis":
+		return NewRedisLimiter(redisUrl)
+	default:
+		return nil, fmt.Errorf("unknown rate limiter %q", kind)
+	}
+}
+
+type bucket struct {
+	limit   Limit
+	tokens  float64
+	updated time.Time
+}
+
+type failures struct {
+	count int
+	start time.Time
+}
+
+// MemoryLimiter counts in this process.
+type MemoryLimiter struct {
+	mu       sync.Mutex
+	buckets  map[string]*bucket
+	failures map[string]*failures
+	locks    map[string]time.Time
+}
+
+func NewMemoryLimiter() *MemoryLimiter {
+	l := &MemoryLimiter{
+		buckets:  make(map[string]*bucket),
+		failures: make(map[string]*failures),
+		locks:    make(map[string]time.Time),
+	}
+	go func() {
+		for range time.Tick(LIMITER_SWEEP) {
+			l.sweep()
+		}
+	}()
+	return l
+}
+
+func (l *MemoryLimiter) Take(ctx context.Context, key string, limit Limit) (LimitResult, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{limit: limit, tokens: float64(limit.Burst), updated: now}
+		l.buckets[key] = b
+	}
+	res, tokens := limit.take(b.tokens, now.Sub(b.updated))
+	b.limit, b.tokens, b.updated = limit, tokens, now
+	return res, nil
+}
+
+func (l *MemoryLimiter) Fail(ctx context.Context, key string, lockout Lockout) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	f, ok := l.failures[key]
+	if !ok || now.Sub(f.start) > lockout.Window {
+		f = &failures{start: now}
+		l.failures[key] = f
+	}
+	f.count++
+	if f.count < lockout.Max {
+		return 0, nil
+	}
+	delete(l.failures, key)
+	l.locks[key] = now.Add(lockout.Duration)
+	return lockout.Duration, nil
+}
+
+func (l *MemoryLimiter) Locked(ctx context.Context, key string) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if d := time.Until(l.locks[key]); d > 0 {
+		return d, nil
+	}
+	return 0, nil
+}
+
+func (l *MemoryLimiter) Reset(ctx context.Context, key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, key)
+	return nil
+}
+
+// Forget full buckets, old failures and expired locks: they are the same as none.
+func (l *MemoryLimiter) sweep() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for key, b := range l.buckets {
+		if now.Sub(b.updated) >= b.limit.Per {
+			delete(l.buckets, key)
+		}
+	}
+	for key, f := range l.failures {
+		if now.Sub(f.start) > loginLockout.Window {
+			delete(l.failures, key)
+		}
+	}
+	for key, until := range l.locks {
+		if now.After(until) {
+			delete(l.locks, key)
+		}
+	}
+}
+
+// Draw from the bucket in a hash {tokens, updated}, which expires once it would be full again. The time
+// is passed in: scripts may not read the clock of Redis before version 5.
+var takeScript = redis.NewScript(`
+local burst, rate, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens, updated = tonumber(b[1]) or burst, tonumber(b[2]) or now
+local elapsed = math.max(0, now - updated)
+local left = math.min(burst, tokens + elapsed * rate)
+if left >= 1 then
+	left = left - 1
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(left), 'updated', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate) + 1000)
+return {tostring(tokens), tostring(elapsed)}
+`)
+
+// Count a failure in a counter that expires after the window, and lock the key when it reaches the max.
+var failScript = redis.NewScript(`
+local count = redis.call('INCR', KEYS[1])
+if count == 1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+if count >= tonumber(ARGV[2]) then
+	redis.call('DEL', KEYS[1])
+	redis.call('SET', KEYS[2], '1', 'PX', ARGV[3])
+	return 1
+end
+return 0
+`)
+
+// RedisLimiter counts at Redis, for every instance together.
+type RedisLimiter struct {
+	client *redis.Client
+}
+
+func NewRedisLimiter(url string) (*RedisLimiter, error) {
+	opt, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opt)
+	if err := client.Ping().Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &RedisLimiter{client: client}, nil
+}
+
+func (l *RedisLimiter) Take(ctx context.Context, key string, limit Limit) (LimitResult, error) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	vals, err := takeScript.Run(l.client.WithContext(ctx), []string{"social-radar:bucket:" + key},
+		limit.Burst, limit.rate()/1000, now).Result()
+	if err != nil {
+		return LimitResult{}, err
+	}
+	// The script returns the bucket as it was, the result is worked out here like in memory.
+	list, ok := vals.([]interface{})
+	if !ok || len(list) != 2 {
+		return LimitResult{}, fmt.Errorf("unexpected rate limit script result %v", vals)
+	}
+	tokens, err := strconv.ParseFloat(fmt.Sprint(list[0]), 64)
+	if err != nil {
+		return LimitResult{}, err
+	}
+	elapsed, err := strconv.ParseFloat(fmt.Sprint(list[1]), 64)
+	if err != nil {
+		return LimitResult{}, err
+	}
+	res, _ := limit.take(tokens, time.Duration(elapsed*float64(time.Millisecond)))
+	return res, nil
+}
+
+func (l *RedisLimiter) Fail(ctx context.Context, key string, lockout Lockout) (time.Duration, error) {
+	locked, err := failScript.Run(l.client.WithContext(ctx),
+		[]string{"social-radar:failures:" + key, "social-radar:lock:" + key},
+		int64(lockout.Window/time.Millisecond), lockout.Max, int64(lockout.Duration/time.Millisecond)).Int64()
+	if err != nil || locked == 0 {
+		return 0, err
+	}
+	return lockout.Duration, nil
+}
+
+func (l *RedisLimiter) Locked(ctx context.Context, key string) (time.Duration, error) {
+	d, err := l.client.WithContext(ctx).PTTL("social-radar:lock:" + key).Result()
+	if err != nil || d < 0 {
+		return 0, err // -2 if there is no lock, -1 if it has no expiry, which never happens.
+	}
+	return d, nil
+}
+
+func (l *RedisLimiter) Reset(ctx context.Context, key string) error {
+	return l.client.WithContext(ctx).Del("social-radar:failures:" + key).Err()
+}
+
+// Middleware that limits the requests of each client to the route named name, see rateLimits.
+func rateLimited(name string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := rateLimits[name]
+		if r.Method == "OPTIONS" || limit.Burst == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		res, err := rateLimiter.Take(r.Context(), name+":"+clientKey(r), limit)
+		if err != nil {
+			rateLimitErrors.Add(1)
+			fmt.Printf("Failed to rate limit %s %v.\n", r.URL.Path, err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+		if !res.Allowed {
+			rateLimited429.Add(1)
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(res.Retry)))
+			writeError(w, r, ErrRateLimited)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/**
+ *  Helper functions:
+ */
+// Function that checks a login like checkUser, unless the username is locked out by failed attempts,
+// and locks it once it failed loginLockout.Max times.
+func checkLogin(ctx context.Context, w http.ResponseWriter, username, password string) error {
+	key := "login:" + strings.ToLower(username)
+	locked, err := rateLimiter.Locked(ctx, key)
+	if err != nil {
+		rateLimitErrors.Add(1)
+		fmt.Printf("Failed to read lockout of %s %v.\n", username, err)
+	}
+	if locked > 0 {
+		loginsLockedOut.Add(1)
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(locked)))
+		return ErrLockedOut
+	}
+
+	err = checkUser(ctx, userStore, username, password)
+	if err == ErrWrongCredentials && loginLockout.Max > 0 {
+		locked, lockErr := rateLimiter.Fail(ctx, key, loginLockout)
+		if lockErr != nil {
+			rateLimitErrors.Add(1)
+			fmt.Printf("Failed to record failed login of %s %v.\n", username, lockErr)
+		}
+		if locked > 0 {
+			fmt.Printf("Locked out %s for %v after %d failed logins\n", username, locked, loginLockout.Max)
+		}
+	}
+	if err == nil {
+		if err := rateLimiter.Reset(ctx, key); err != nil {
+			rateLimitErrors.Add(1)
+			fmt.Printf("Failed to clear failed logins of %s %v.\n", username, err)
+		}
+	}
+	return err
+}
+
+// The client a request counts against: its user if it carries a JWT, else its IP.
+func clientKey(r *http.Request) string {
+	if r.Context().Value("user") != nil {
+		if user := getUsername(r); user != "" {
+			return "user:" + user
+		}
+	}
+	return "ip:" + clientIP(r)
+}
+
+// The IP of the client, see PROXY_HOPS at the top of this module.
+func clientIP(r *http.Request) string {
+	if proxyHops > 0 {
+		var addrs []string
+		for _, h := range r.Header["X-Forwarded-For"] {
+			for _, a := range strings.Split(h, ",") {
+				addrs = append(addrs, strings.TrimSpace(a))
+			}
+		}
+		if i := len(addrs) - 1 - proxyHops; i >= 0 && net.ParseIP(addrs[i]) != nil {
+			return addrs[i]
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Read a limit such as "10/1m" from the environment, or "off" for none, falling back to def if it is
+// unset or malformed.
+func envLimit(name string, def Limit) Limit {
+	val := envString(name, "")
+	if val == "" {
+		return def
+	}
+	if val == "off" {
+		return Limit{}
+	}
+	parts := strings.SplitN(val, "/", 2)
+	if len(parts) == 2 {
+		n, err := strconv.Atoi(parts[0])
+		d, err2 := time.ParseDuration(parts[1])
+		if err == nil && err2 == nil && n > 0 && d > 0 {
+			return Limit{Burst: n, Per: d}
+		}
+	}
+	fmt.Printf("Ignoring invalid %s=%q, using %d/%v.\n", name, val, def.Burst, def.Per)
+	return def
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// Round up to whole seconds, as the headers want.
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,234 @@
+package main
+
+// This module lets users react to posts:
+//
+//	PUT    /api/v1/posts/{id}/reactions/{kind}   react, doing it twice counts once
+//	DELETE /api/v1/posts/{id}/reactions/{kind}   take the reaction back
+//
+// Each reaction is a document in the reaction index with the id post:user:kind. The post itself keeps
+// the number of reactions of each kind and their total, so search results carry them for free and can
+// be sorted by them. A counter update that fails goes to the outbox, which recounts the post from the
+// reaction index (see updatePostCounter).
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/olivere/elastic"
+)
+
+const (
+	REACTION_INDEX = "reaction"
+	REACTION_TYPE  = "reaction"
+)
+
+// The reactions a user can leave on a post. Clients pick the emoji to show for each.
+var reactionKinds = []string{"like", "love", "haha", "wow", "sad", "angry"}
+
+// Reaction is one user reacting to one post.
+type Reaction struct {
+	PostId  string    `json:"post_id"`
+	User    string    `json:"user"`
+	Kind    string    `json:"kind"`
+	Created time.Time `json:"created"`
+}
+
+// Adds delta to the counter of one kind and recomputes the total.
+const REACTION_COUNT_SCRIPT = `
+if (ctx._source.reactions == null) { ctx._source.reactions = [:]; }
+def n = ctx._source.reactions.containsKey(params.kind) ? ctx._source.reactions[params.kind] : 0;
+ctx._source.reactions[params.kind] = Math.max(0, n + params.delta);
+long total = 0;
+for (def c : ctx._source.reactions.values()) { total += c; }
+ctx._source.reaction_count = total;
+`
+
+func reactionId(postId, user, kind string) string {
+	return postId + ":" + user + ":" + kind
+}
+
+func isReactionKind(kind string) bool {
+	for _, k := range reactionKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler for PUT and DELETE on /posts/{id}/reactions/{kind}. Both are idempotent and answer 204.
+func handlerReaction(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
+	w.Header().Set("Access-Control-Allow-Methods", "PUT,DELETE")
+
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	vars := mux.Vars(r)
+	var v ValidationError
+	if !isReactionKind(vars["kind"]) {
+		v.Add("kind", "must be one of "+strings.Join(reactionKinds, ", "))
+	}
+	if err := v.Err(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	var err error
+	if r.Method == "DELETE" {
+		err = removeReaction(r.Context(), esClient, vars["id"], getUsername(r), vars["kind"])
+	} else {
+		err = addReaction(r.Context(), esClient, vars["id"], getUsername(r), vars["kind"])
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/**
+ *  Helper functions:
+ */
+// Function that saves a reaction of user to a post and counts it, unless the user already reacted so.
+func addReaction(ctx context.Context, client *elastic.Client, postId, user, kind string) error {
+	if _, err := readPostFromES(ctx, client, postId); err != nil {
+		return err
+	}
+
+	indexCtx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+	_, err := client.Index().
+		Index(REACTION_INDEX).
+		Type(REACTION_TYPE).
+		Id(reactionId(postId, user, kind)).
+		OpType("create").
+		BodyJson(Reaction{PostId: postId, User: user, Kind: kind, Created: time.Now()}).
+		Refresh("wait_for").
+		Do(indexCtx)
+	if elastic.IsConflict(err) {
+		return nil // already counted.
+	}
+	if err != nil {
+		return err
+	}
+
+	countReaction(ctx, client, postId, kind, 1)
+	return nil
+}
+
+// Function that takes a reaction of user back, if there is one.
+func removeReaction(ctx context.Context, client *elastic.Client, postId, user, kind string) error {
+	deleteCtx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+	_, err := client.Delete().
+		Index(REACTION_INDEX).
+		Type(REACTION_TYPE).
+		Id(reactionId(postId, user, kind)).
+		Refresh("wait_for").
+		Do(deleteCtx)
+	if elastic.IsNotFound(err) {
+		return nil // nothing to take back.
+	}
+	if err != nil {
+		return err
+	}
+
+	countReaction(ctx, client, postId, kind, -1)
+	return nil
+}
+
+// Add delta to a reaction counter of a post.
+func countReaction(ctx context.Context, client *elastic.Client, postId, kind string, delta int) {
+	script := elastic.NewScript(REACTION_COUNT_SCRIPT).Params(map[string]interface{}{"kind": kind, "delta": delta})
+	updatePostCounter(ctx, client, postId, script, "reactions.recount")
+}
+
+// Function that sets the reaction counters of a post from the reaction index.
+func recountReactions(ctx context.Context, client *elastic.Client, postId string) error {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	searchResult, err := client.Search().
+		Index(REACTION_INDEX).
+		Query(elastic.NewTermQuery("post_id", postId)).
+		Size(0).
+		Aggregation("kinds", elastic.NewTermsAggregation().Field("kind").Size(len(reactionKinds))).
+		Do(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Every kind is written, also those at 0, so counts of reactions since taken back are reset too.
+	counts := make(map[string]int64, len(reactionKinds))
+	for _, k := range reactionKinds {
+		counts[k] = 0
+	}
+	var total int64
+	if agg, ok := searchResult.Aggregations.Terms("kinds"); ok {
+		for _, b := range agg.Buckets {
+			if kind, ok := b.Key.(string); ok {
+				counts[kind] = b.DocCount
+				total += b.DocCount
+			}
+		}
+	}
+	return updatePostInES(ctx, client, postId, map[string]interface{}{"reactions": counts, "reaction_count": total})
+}
+
+// Function that removes every reaction to a post, when the post is deleted.
+func deleteReactions(ctx context.Context, client *elastic.Client, postId string) error {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	_, err := client.DeleteByQuery(REACTION_INDEX).
+		Query(elastic.NewTermQuery("post_id", postId)).
+		Refresh("true").
+		Do(ctx)
+	return err
+}
+
+// Function that fills in MyReactions of posts for the user viewing them. It is best effort: posts are
+// still worth showing without it.
+func addViewerReactions(ctx context.Context, client *elastic.Client, user string, posts []Post) {
+	if len(posts) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	ids := make([]interface{}, len(posts))
+	for i, p := range posts {
+		ids[i] = p.Id
+	}
+	searchResult, err := client.Search().
+		Index(REACTION_INDEX).
+		Query(elastic.NewBoolQuery().Filter(
+			elastic.NewTermQuery("user", user),
+			elastic.NewTermsQuery("post_id", ids...),
+		)).
+		Size(len(posts) * len(reactionKinds)).
+		Do(ctx)
+	if err != nil {
+		fmt.Printf("Failed to read reactions of %s %v.\n", user, err)
+		return
+	}
+
+	mine := make(map[string][]string)
+	var rtyp Reaction
+	for _, item := range searchResult.Each(reflect.TypeOf(rtyp)) {
+		if rc, ok := item.(Reaction); ok {
+			mine[rc.PostId] = append(mine[rc.PostId], rc.Kind)
+		}
+	}
+	for i := range posts {
+		posts[i].MyReactions = mine[posts[i].Id]
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+// This module is the Server-Sent Events fallback of the /stream WebSocket (stream.go), for networks
+// that block WebSockets:
+//
+//	GET /api/v1/stream/events?lat=...&lon=...&range=...   or ?top=...&left=...&bottom=...&right=...
+//
+// The area and the min_face and type filters are the query parameters of /stream, and the JWT may be
+// passed as ?token= since EventSource cannot set headers either. Each new post is an event "post" whose
+// data is the post as JSON and whose id is the one /stream sends, a deleted post is an event "deleted".
+// To move the area, open a new EventSource with ?last_event_id= set to the last id received, so that
+// nothing is missed in between. Reconnections of the browser send the Last-Event-ID header and are
+// resumed the same way. When the server no longer has every post since that id, it sends an event
+// "reset" first: search again.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const SSE_RETRY = 3 * time.Second // how long browsers wait before reconnecting.
+
+// Handler for GET /stream/events.
+func handlerEvents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization,Last-Event-ID")
+
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	q := r.URL.Query()
+	area, err := areaFromQuery(q.Get)
+	var filter StreamFilter
+	if err == nil {
+		filter, err = filterFromQuery(q.Get)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, internalError("Streaming is not supported", nil))
+		return
+	}
+
+	user := getUsername(r)
+	fmt.Printf("%s connected to the event stream\n", user)
+	streamClients.Add(1)
+	defer streamClients.Add(-1)
+
+	s := newSubscriber(user)
+	var missed []streamEvent
+	current, complete := "", true
+	lastId := r.Header.Get("Last-Event-ID")
+	if lastId == "" {
+		lastId = q.Get("last_event_id")
+	}
+	if lastId != "" {
+		missed, current, complete = streamHub.Resume(s, area, filter, lastId)
+	} else {
+		streamHub.Subscribe(s, area, filter)
+	}
+	defer streamHub.Unsubscribe(s)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // proxies must pass events on as they come.
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "retry: %d\n\n", SSE_RETRY/time.Millisecond)
+	if !complete {
+		writeEvent(w, current, "reset", []byte("{}"))
+	}
+	for _, e := range missed {
+		if err := writePostEvent(w, e); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(STREAM_PING_INTERVAL)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case e := <-s.events:
+			err = writePostEvent(w, e)
+		case <-ticker.C:
+			// A comment, ignored by EventSource, so that idle connections are not dropped by proxies.
+			_, err = fmt.Fprint(w, ": ping\n\n")
+		case <-r.Context().Done():
+			fmt.Printf("%s left the event stream\n", user)
+			return
+		}
+		if err != nil {
+			fmt.Printf("%s left the event stream: %v\n", user, err)
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+/**
+ *  Helper functions:
+ */
+func writePostEvent(w http.ResponseWriter, e streamEvent) error {
+	js, err := json.Marshal(e.Post)
+	if err != nil {
+		return err
+	}
+	return writeEvent(w, e.Id, streamMessageType(e), js)
+}
+
+// Write one event. data must not contain newlines, which JSON from json.Marshal never does.
+func writeEvent(w http.ResponseWriter, id, event string, data []byte) error {
+	if id != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
@@ -0,0 +1,627 @@
+package main
+
+// This module pushes new posts to clients as they are saved, instead of clients polling /search:
+//
+//	GET /api/v1/stream   WebSocket, posts inside the area the client subscribed to
+//
+// The area is a circle (lat, lon and a range in kilometers, like /search) or a box (top, left, bottom,
+// right). It can be given as query parameters of the upgrade request, and changed at any time by sending
+//
+//	{"type": "subscribe", "area": {"lat": 37.77, "lon": -122.42, "range": 5}}
+//
+// for example when the map pans. A "filter" next to the area, or the query parameters min_face and type,
+// only lets through posts with at least that face score (see annotate) or of that type. The server
+// answers {"type": "subscribed"} or {"type": "error", "error": {...}} with the usual error object, and
+// sends {"type": "post", "id": "...", "post": {...}} for each new post, and the same with the type
+// "deleted" when a post is deleted. Browsers cannot set headers on a
+// WebSocket, so the JWT may also be passed as ?token=. Networks that block WebSockets can use the
+// Server-Sent Events of sse.go instead.
+//
+// Subscriptions live in a StreamHub in this process, indexed by grid cells so that a post is only
+// matched against the subscribers whose area overlaps its cell. The hub numbers the posts it publishes
+// and keeps the recent ones, so that a client which lost its connection can be sent what it missed.
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	STREAM_CELL_DEGREES = 1.0  // size of a grid cell of the subscription index.
+	STREAM_MAX_CELLS    = 1000 // areas over more cells are matched against every post instead.
+	STREAM_BUFFER       = 64   // posts waiting to be sent to one client, more are dropped.
+	STREAM_REPLAY_SIZE  = 1000 // recent posts kept to resume from.
+	STREAM_REPLAY_AGE   = 5 * time.Minute
+
+	STREAM_WRITE_TIMEOUT = 10 * time.Second
+	STREAM_PING_INTERVAL = 30 * time.Second
+	STREAM_PONG_TIMEOUT  = 2 * STREAM_PING_INTERVAL // a client that stops answering pings is gone.
+	STREAM_MAX_MESSAGE   = 4096                     // bytes in a message from a client.
+
+	EARTH_RADIUS_KM = 6371.0
+	KM_PER_DEGREE   = math.Pi * EARTH_RADIUS_KM / 180
+)
+
+var (
+	streamClients   = expvar.NewInt("stream_clients")
+	streamDelivered = expvar.NewInt("stream_delivered")
+	streamDropped   = expvar.NewInt("stream_dropped")
+)
+
+// The subscriptions of this process, subscribed to the EventBus in main.
+var streamHub = NewStreamHub()
+
+// Event ids start with this, so that ids from before a restart are not mistaken for new ones.
+var streamEpoch = strconv.FormatInt(time.Now().UnixNano(), 36)
+
+// The token is checked by the JWT middleware, this only upgrades the connection. Every origin may connect
+// like every origin may call the rest of the API: requests are authorized by the token, not by cookies.
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// AreaRequest is an area as sent by a client, either a circle (lat, lon, range) or a box (top, left,
+// bottom, right). The range is in kilometers.
+type AreaRequest struct {
+	Lat    *float64 `json:"lat"`
+	Lon    *float64 `json:"lon"`
+	Range  *float64 `json:"range"`
+	Top    *float64 `json:"top"`
+	Left   *float64 `json:"left"`
+	Bottom *float64 `json:"bottom"`
+	Right  *float64 `json:"right"`
+}
+
+// Area is a validated AreaRequest. A box whose left is east of its right crosses the antimeridian.
+type Area struct {
+	Box                      bool
+	Center                   Location
+	Km                       float64
+	Top, Left, Bottom, Right float64
+}
+
+// StreamFilter narrows a subscription down to some posts of its area, the zero value lets all through.
+type StreamFilter struct {
+	MinFace float64 `json:"min_face,omitempty"` // face score between 0 and 1, see annotate.
+	Type    string  `json:"type,omitempty"`     // "image", "video", "text"...
+}
+
+// StreamMessage is a message on a /stream connection, in either direction.
+type StreamMessage struct {
+	Type   string        `json:"type"`
+	Id     string        `json:"id,omitempty"`
+	Area   *AreaRequest  `json:"area,omitempty"`
+	Filter *StreamFilter `json:"filter,omitempty"`
+	Post   *Post         `json:"post,omitempty"`
+	Error  *ErrorBody    `json:"error,omitempty"`
+}
+
+// streamEvent is a published post event with the id clients resume from.
+type streamEvent struct {
+	Id   string
+	Type string // POST_CREATED or POST_DELETED.
+	seq  int64
+	time time.Time
+	Post *Post
+}
+
+type cell struct {
+	lat, lon int
+}
+
+// subscriber is one client of the stream.
+type subscriber struct {
+	user   string
+	area   Area // area and filter are guarded by the hub's lock.
+	filter StreamFilter
+	cells  []cell
+	wide   bool
+	events chan streamEvent
+}
+
+// StreamHub matches new posts against the areas clients subscribed to.
+type StreamHub struct {
+	mu     sync.Mutex
+	cells  map[cell]map[*subscriber]bool
+	wide   map[*subscriber]bool // subscribers over more than STREAM_MAX_CELLS cells.
+	subs   map[*subscriber]bool
+	seq    int64
+	replay []streamEvent // the recent events, oldest first.
+}
+
+func NewStreamHub() *StreamHub {
+	return &StreamHub{
+		cells: make(map[cell]map[*subscriber]bool),
+		wide:  make(map[*subscriber]bool),
+		subs:  make(map[*subscriber]bool),
+	}
+}
+
+func newSubscriber(user string) *subscriber {
+	return &subscriber{user: user, events: make(chan streamEvent, STREAM_BUFFER)}
+}
+
+// Start sending s the posts inside a that pass f, or move it there if it is already subscribed.
+func (h *StreamHub) Subscribe(s *subscriber, a Area, f StreamFilter) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.add(s, a, f)
+}
+
+// Subscribe s and return the posts it would have been sent after the event lastId. Those come before
+// anything sent to s, so nothing is missed or sent twice. If the hub no longer knows every post since
+// lastId, e.g. because it restarted, complete is false and the client should search again; current is
+// then the id to resume from next time.
+func (h *StreamHub) Resume(s *subscriber, a Area, f StreamFilter, lastId string) (missed []streamEvent, current string, complete bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.add(s, a, f)
+
+	epoch, seq := parseEventId(lastId)
+	h.trim(time.Now())
+	known := epoch == streamEpoch && seq <= h.seq
+	if known && seq < h.seq {
+		known = len(h.replay) > 0 && h.replay[0].seq <= seq+1
+	}
+	if !known {
+		return nil, eventId(h.seq), false
+	}
+	for _, e := range h.replay {
+		if e.seq > seq && s.matches(e.Post) {
+			missed = append(missed, e)
+		}
+	}
+	return missed, "", true
+}
+
+// Must be called with the lock held.
+func (h *StreamHub) add(s *subscriber, a Area, f StreamFilter) {
+	h.remove(s)
+	s.area = a
+	s.filter = f
+	s.cells = a.cells()
+	s.wide = s.cells == nil
+	if s.wide {
+		h.wide[s] = true
+	}
+	for _, c := range s.cells {
+		if h.cells[c] == nil {
+			h.cells[c] = make(map[*subscriber]bool)
+		}
+		h.cells[c][s] = true
+	}
+	h.subs[s] = true
+}
+
+// Stop sending posts to s.
+func (h *StreamHub) Unsubscribe(s *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(s)
+}
+
+// Send the event of a post to every subscriber whose area contains the post, without blocking: a client
+// that does not keep up misses posts rather than holding up the one who posted. Events come from the
+// EventBus (see bus.go).
+func (h *StreamHub) Publish(pe PostEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	p := pe.Post
+	h.seq++
+	e := streamEvent{Id: eventId(h.seq), Type: pe.Type, seq: h.seq, time: time.Now(), Post: p}
+	h.replay = append(h.replay, e)
+	h.trim(e.time)
+
+	for s := range h.cells[cellOf(p.Location)] {
+		h.deliver(s, e)
+	}
+	for s := range h.wide {
+		h.deliver(s, e)
+	}
+}
+
+func (h *StreamHub) deliver(s *subscriber, e streamEvent) {
+	if !s.matches(e.Post) {
+		return
+	}
+	select {
+	case s.events <- e:
+		streamDelivered.Add(1)
+	default:
+		streamDropped.Add(1)
+	}
+}
+
+// Forget the events that are too many or too old to resume from. Must be called with the lock held.
+func (h *StreamHub) trim(now time.Time) {
+	n := 0
+	if len(h.replay) > STREAM_REPLAY_SIZE {
+		n = len(h.replay) - STREAM_REPLAY_SIZE
+	}
+	for n < len(h.replay) && now.Sub(h.replay[n].time) > STREAM_REPLAY_AGE {
+		n++
+	}
+	h.replay = h.replay[n:]
+}
+
+// Must be called with the lock held.
+func (h *StreamHub) remove(s *subscriber) {
+	if !h.subs[s] {
+		return
+	}
+	for _, c := range s.cells {
+		delete(h.cells[c], s)
+		if len(h.cells[c]) == 0 {
+			delete(h.cells, c)
+		}
+	}
+	delete(h.wide, s)
+	delete(h.subs, s)
+}
+
+// Handler for the /stream WebSocket.
+func handlerStream(w http.ResponseWriter, r *http.Request) {
+	// The first area is optional, a client may subscribe after connecting.
+	var area *Area
+	q := r.URL.Query()
+	filter, err := filterFromQuery(q.Get)
+	if err == nil && q.Get("lat")+q.Get("lon")+q.Get("top")+q.Get("left")+q.Get("bottom")+q.Get("right") != "" {
+		var a Area
+		a, err = areaFromQuery(q.Get)
+		area = &a
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already answered with an HTTP error.
+		fmt.Printf("Failed to upgrade to a WebSocket %v.\n", err)
+		return
+	}
+	defer conn.Close()
+
+	user := getUsername(r)
+	fmt.Printf("%s connected to the stream\n", user)
+	streamClients.Add(1)
+	defer streamClients.Add(-1)
+
+	s := newSubscriber(user)
+	if area != nil {
+		streamHub.Subscribe(s, *area, filter)
+	}
+	defer streamHub.Unsubscribe(s)
+
+	// Only one goroutine may write to the connection, replies to the client go through writeStream too.
+	replies := make(chan StreamMessage, 1)
+	done, stopped := make(chan struct{}), make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(stopped)
+		writeStream(conn, s, replies, done)
+	}()
+	reply := func(msg StreamMessage) bool {
+		select {
+		case replies <- msg:
+			return true
+		case <-stopped:
+			return false
+		}
+	}
+
+	conn.SetReadLimit(STREAM_MAX_MESSAGE)
+	conn.SetReadDeadline(time.Now().Add(STREAM_PONG_TIMEOUT))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(STREAM_PONG_TIMEOUT))
+	})
+	for {
+		var msg StreamMessage
+		err := conn.ReadJSON(&msg)
+		switch err.(type) {
+		case nil:
+		case *json.SyntaxError, *json.UnmarshalTypeError:
+			// The message was read whole, the connection can go on.
+			if !reply(streamError(r, badRequest("invalid_json", "Failed to parse JSON input from client", err))) {
+				return
+			}
+			continue
+		default:
+			fmt.Printf("%s left the stream: %v\n", user, err)
+			return
+		}
+
+		var answer StreamMessage
+		switch msg.Type {
+		case "subscribe":
+			a, err := msg.Area.area()
+			f := StreamFilter{}
+			if msg.Filter != nil {
+				f = *msg.Filter
+			}
+			if err == nil {
+				err = f.validate()
+			}
+			if err != nil {
+				answer = streamError(r, err)
+				break
+			}
+			streamHub.Subscribe(s, a, f)
+			answer = StreamMessage{Type: "subscribed"}
+		case "unsubscribe":
+			streamHub.Unsubscribe(s)
+			answer = StreamMessage{Type: "unsubscribed"}
+		default:
+			answer = streamError(r, badRequest("invalid_message", "Unknown message type "+strconv.Quote(msg.Type), nil))
+		}
+		if !reply(answer) {
+			return
+		}
+	}
+}
+
+/**
+ *  Helper functions:
+ */
+// Send the posts of s and the replies to the client until done is closed or the client is gone, and
+// ping it so that idle connections are not dropped by proxies.
+func writeStream(conn *websocket.Conn, s *subscriber, replies <-chan StreamMessage, done <-chan struct{}) {
+	ticker := time.NewTicker(STREAM_PING_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		var err error
+		// The deadline is set right before each write: it is absolute, one set before waiting would
+		// expire while the connection is idle.
+		select {
+		case e := <-s.events:
+			conn.SetWriteDeadline(time.Now().Add(STREAM_WRITE_TIMEOUT))
+			err = conn.WriteJSON(StreamMessage{Type: streamMessageType(e), Id: e.Id, Post: e.Post})
+		case msg := <-replies:
+			conn.SetWriteDeadline(time.Now().Add(STREAM_WRITE_TIMEOUT))
+			err = conn.WriteJSON(msg)
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(STREAM_WRITE_TIMEOUT))
+			err = conn.WriteMessage(websocket.PingMessage, nil)
+		case <-done:
+			return
+		}
+		if err != nil {
+			// Closing makes the read loop in handlerStream fail and clean up.
+			conn.Close()
+			return
+		}
+	}
+}
+
+// Created posts are sent as "post", deleted ones as "deleted".
+func streamMessageType(e streamEvent) string {
+	if e.Type == POST_DELETED {
+		return "deleted"
+	}
+	return "post"
+}
+
+func streamError(r *http.Request, err error) StreamMessage {
+	_, body := errorBody(r, err)
+	return StreamMessage{Type: "error", Error: &body}
+}
+
+// Parse an area from query parameters, the same way as the JSON one. get is e.g. r.URL.Query().Get.
+func areaFromQuery(get func(string) string) (Area, error) {
+	var v ValidationError
+	var req AreaRequest
+	for _, f := range []struct {
+		name string
+		dst  **float64
+	}{
+		{"lat", &req.Lat}, {"lon", &req.Lon}, {"range", &req.Range},
+		{"top", &req.Top}, {"left", &req.Left}, {"bottom", &req.Bottom}, {"right", &req.Right},
+	} {
+		val := get(f.name)
+		if val == "" {
+			continue
+		}
+		n, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			v.Add(f.name, "must be a number")
+			continue
+		}
+		*f.dst = &n
+	}
+	if err := v.Err(); err != nil {
+		return Area{}, err
+	}
+	return req.area()
+}
+
+// Parse the optional filter of a subscription from query parameters.
+func filterFromQuery(get func(string) string) (StreamFilter, error) {
+	f := StreamFilter{Type: get("type")}
+	if val := get("min_face"); val != "" {
+		n, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			var v ValidationError
+			v.Add("min_face", "must be a number")
+			return f, v.Err()
+		}
+		f.MinFace = n
+	}
+	return f, f.validate()
+}
+
+func (f StreamFilter) validate() error {
+	var v ValidationError
+	if !(f.MinFace >= 0 && f.MinFace <= 1) {
+		v.Add("min_face", "must be between 0 and 1")
+	}
+	if f.Type != "" && f.Type != TEXT_TYPE && f.Type != "image" && f.Type != "video" {
+		v.Add("type", "must be image, video or text")
+	}
+	return v.Err()
+}
+
+// Check if s wants to be sent a post. Must be called with the hub's lock held.
+func (s *subscriber) matches(p *Post) bool {
+	if !s.area.contains(p.Location) || p.Face < s.filter.MinFace {
+		return false
+	}
+	return s.filter.Type == "" || s.filter.Type == p.Type
+}
+
+func eventId(seq int64) string {
+	return streamEpoch + "-" + strconv.FormatInt(seq, 10)
+}
+
+// Split an event id into the epoch and the number of the event.
+func parseEventId(id string) (string, int64) {
+	i := strings.LastIndex(id, "-")
+	if i < 0 {
+		return "", 0
+	}
+	seq, err := strconv.ParseInt(id[i+1:], 10, 64)
+	if err != nil {
+		return "", 0
+	}
+	return id[:i], seq
+}
+
+// Validate an area sent by a client.
+func (req *AreaRequest) area() (Area, error) {
+	var v ValidationError
+	if req == nil {
+		v.Add("area", "is required")
+		return Area{}, v.Err()
+	}
+
+	coordinate := func(field string, val *float64, limit float64) float64 {
+		if val == nil {
+			v.Add(field, "is required")
+			return 0
+		}
+		if !(*val >= -limit && *val <= limit) {
+			v.Add(field, fmt.Sprintf("must be between %g and %g", -limit, limit))
+		}
+		return *val
+	}
+
+	var a Area
+	if req.Top != nil || req.Left != nil || req.Bottom != nil || req.Right != nil {
+		a.Box = true
+		a.Top = coordinate("top", req.Top, 90)
+		a.Left = coordinate("left", req.Left, 180)
+		a.Bottom = coordinate("bottom", req.Bottom, 90)
+		a.Right = coordinate("right", req.Right, 180)
+		if a.Bottom > a.Top {
+			v.Add("bottom", "must not be north of top")
+		}
+		return a, v.Err()
+	}
+
+	a.Center = Location{
+		Lat: coordinate("lat", req.Lat, 90),
+		Lon: coordinate("lon", req.Lon, 180),
+	}
+	a.Km = coordinate("range", req.Range, MAX_RANGE_KM)
+	if req.Range != nil && a.Km <= 0 {
+		v.Add("range", fmt.Sprintf("must be greater than 0 and at most %g", MAX_RANGE_KM))
+	}
+	return a, v.Err()
+}
+
+// Check if a location lies inside the area.
+func (a Area) contains(l Location) bool {
+	if !a.Box {
+		return distanceKm(a.Center, l) <= a.Km
+	}
+	if l.Lat > a.Top || l.Lat < a.Bottom {
+		return false
+	}
+	if a.Left <= a.Right {
+		return l.Lon >= a.Left && l.Lon <= a.Right
+	}
+	return l.Lon >= a.Left || l.Lon <= a.Right
+}
+
+// The grid cells the area overlaps, or nil if there are more than STREAM_MAX_CELLS.
+func (a Area) cells() []cell {
+	top, left, bottom, right := a.Top, a.Left, a.Bottom, a.Right
+	if !a.Box {
+		dLat := a.Km / KM_PER_DEGREE
+		top, bottom = a.Center.Lat+dLat, a.Center.Lat-dLat
+		// Degrees of longitude shrink towards the poles, near them the circle goes all the way round.
+		cos := math.Cos(math.Min(math.Abs(a.Center.Lat)+dLat, 90) * math.Pi / 180)
+		if cos*KM_PER_DEGREE*180 <= a.Km {
+			left, right = -180, 180
+		} else {
+			dLon := a.Km / (KM_PER_DEGREE * cos)
+			left, right = wrapLon(a.Center.Lon-dLon), wrapLon(a.Center.Lon+dLon)
+		}
+	}
+
+	first, last := cellOf(Location{Lat: bottom, Lon: left}), cellOf(Location{Lat: top, Lon: right})
+	lons := last.lon - first.lon + 1
+	if lons <= 0 || left > right {
+		lons += int(360 / STREAM_CELL_DEGREES) // crosses the antimeridian.
+	}
+	if (last.lat-first.lat+1)*lons > STREAM_MAX_CELLS {
+		return nil
+	}
+
+	var cells []cell
+	maxLon := int(180 / STREAM_CELL_DEGREES)
+	for lat := first.lat; lat <= last.lat; lat++ {
+		for i := 0; i < lons; i++ {
+			lon := first.lon + i
+			if lon >= maxLon {
+				lon -= 2 * maxLon
+			}
+			cells = append(cells, cell{lat, lon})
+		}
+	}
+	return cells
+}
+
+// The grid cell a location falls in. The poles and 180 degrees east go to the cell next to them.
+func cellOf(l Location) cell {
+	lat := int(math.Floor(math.Max(-90, math.Min(l.Lat, 90)) / STREAM_CELL_DEGREES))
+	lon := int(math.Floor(math.Max(-180, math.Min(l.Lon, 180)) / STREAM_CELL_DEGREES))
+	if max := int(90 / STREAM_CELL_DEGREES); lat == max {
+		lat--
+	}
+	if max := int(180 / STREAM_CELL_DEGREES); lon == max {
+		lon--
+	}
+	return cell{lat, lon}
+}
+
+func wrapLon(lon float64) float64 {
+	switch {
+	case lon < -180:
+		return lon + 360
+	case lon > 180:
+		return lon - 360
+	}
+	return lon
+}
+
+// Great circle distance between two locations.
+func distanceKm(a, b Location) float64 {
+	lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	dLat, dLon := lat2-lat1, (b.Lon-a.Lon)*math.Pi/180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * EARTH_RADIUS_KM * math.Asin(math.Sqrt(math.Min(1, h)))
+}
@@ -2,16 +2,23 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"os"
 	"reflect"
 	"regexp"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/olivere/elastic"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // define ElasticSearch database info.
@@ -20,15 +27,73 @@ const (
 	USER_TYPE  = "user" // (same as MySQL database table name).
 )
 
+// Longest password bcrypt can hash, it ignores anything after it.
+const MAX_PASSWORD_LENGTH = 72
+
+// A login for a username that does not exist is checked against this hash, so that it takes as long as
+// one for a user who does and the response time does not tell whether the username is taken.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not the password of anyone"), bcrypt.DefaultCost)
+
+// User is a user as stored in the user index. It holds the password hash, so it is never sent to
+// clients as is; handlers return its Profile instead.
 type User struct {
+	Username     string     `json:"username"`
+	PasswordHash string     `json:"password_hash,omitempty"` // bcrypt.
+	Age          int64      `json:"age"`
+	Gender       string     `json:"gender"`
+	Disabled     bool       `json:"disabled,omitempty"` // set with the admin CLI, a disabled user cannot log in.
+	Created      time.Time  `json:"created"`
+	LastLogin    *time.Time `json:"last_login,omitempty"`
+
+	DisplayName string  `json:"display_name,omitempty"`
+	Bio         string  `json:"bio,omitempty"`
+	AvatarUrl   string  `json:"avatar_url,omitempty"`
+	Privacy     Privacy `json:"privacy"`
+	// GCS object of the avatar, empty if the user never uploaded one.
+	AvatarObject string `json:"avatar_object,omitempty"`
+
+	// Plain text password of a user who signed up before passwords were hashed. It is replaced with a
+	// hash at their next login.
+	LegacyPassword string `json:"legacy_password,omitempty"`
+}
+
+// Credentials is the body of a login request.
+type Credentials struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
-	Age      int64  `json:"age"`
-	Gender   string `json:"gender"`
+}
+
+// SignupRequest is the body of a signup request.
+type SignupRequest struct {
+	Credentials
+	Age    int64  `json:"age"`
+	Gender string `json:"gender"`
 }
 
 var mySigningKey = []byte("secret") // used as private key for encryption.
 
+// Get the username from the token validated by the JWT middleware.
+func getUsername(r *http.Request) string {
+	user := r.Context().Value("user")
+	claims := user.(*jwt.Token).Claims
+	username, _ := claims.(jwt.MapClaims)["username"].(string)
+	return username
+}
+
+// Check if a user may call the admin endpoints. Admins are listed in the comma separated ADMIN_USERS
+// environment variable, so nobody is an admin unless the deployment says so.
+func isAdmin(username string) bool {
+	if username == "" {
+		return false
+	}
+	for _, admin := range strings.Split(os.Getenv("ADMIN_USERS"), ",") {
+		if strings.TrimSpace(admin) == username {
+			return true
+		}
+	}
+	return false
+}
+
 // Handler function that handles user login.
 // It will send back a token (generated with username + mySigningKey + exp date) to front-end.
 func handlerLogin(w http.ResponseWriter, r *http.Request) {
@@ -36,26 +101,16 @@ func handlerLogin(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	fmt.Println("Received one login request")
-	w.Header().Set("Content-Type", "text/plain")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-
 	decoder := json.NewDecoder(r.Body)
-	// Decode the request body to the form a User object.
-	var user User
+	var user Credentials
 	if err := decoder.Decode(&user); err != nil {
-		http.Error(w, "Failed to parse JSON input from client", http.StatusBadRequest)
-		fmt.Printf("Failed to parse JSON input from client %v.\n", err)
+		writeError(w, r, badRequest("invalid_json", "Failed to parse JSON input from client", err))
 		return
 	}
 
-	// Verify user credentials.
-	if err := checkUser(user.Username, user.Password); err != nil {
-		if err.Error() == "Wrong username or password" {
-			http.Error(w, "Wrong username or password", http.StatusUnauthorized)
-		} else {
-			http.Error(w, "Failed to read from ElasticSearch", http.StatusInternalServerError)
-		}
+	// Verify user credentials, unless too many wrong ones were tried for this user (see ratelimit.go).
+	if err := checkLogin(r.Context(), w, user.Username, user.Password); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
@@ -68,8 +123,7 @@ func handlerLogin(w http.ResponseWriter, r *http.Request) {
 	// Convert token object to string for front-end to store.
 	tokenString, err := token.SignedString(mySigningKey)
 	if err != nil {
-		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
-		fmt.Printf("Failed to generate token %v.\n", err)
+		writeError(w, r, internalError("Failed to generate token", err))
 		return
 	}
 
@@ -83,102 +137,308 @@ func handlerSignup(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
 	decoder := json.NewDecoder(r.Body)
-	var user User
+	var user SignupRequest
 	if err := decoder.Decode(&user); err != nil {
-		http.Error(w, "Failed to parse JSON input from client", http.StatusBadRequest)
-		fmt.Printf("Failed to parse JSON input from client %v.\n", err)
+		writeError(w, r, badRequest("invalid_json", "Failed to parse JSON input from client", err))
 		return
 	}
 
-	if user.Username == "" || user.Password == "" || !regexp.MustCompile(`^[a-z0-9_]+$`).MatchString(user.Username) {
-		http.Error(w, "Invalid username or password", http.StatusBadRequest)
-		fmt.Printf("Invalid username or password.\n")
+	var v ValidationError
+	if user.Username == "" || !regexp.MustCompile(`^[a-z0-9_]+$`).MatchString(user.Username) {
+		v.Add("username", "must only contain lowercase letters, digits and underscores")
+	}
+	if user.Password == "" {
+		v.Add("password", "is required")
+	} else if len(user.Password) > MAX_PASSWORD_LENGTH {
+		v.Add("password", fmt.Sprintf("must be at most %d bytes long", MAX_PASSWORD_LENGTH))
+	}
+	v.Age("age", user.Age)
+	v.Text("gender", user.Gender, MAX_GENDER_LENGTH)
+	if err := v.Err(); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	if err := addUser(user); err != nil {
-		if err.Error() == "User already exists" {
-			http.Error(w, "User already exists", http.StatusBadRequest)
-		} else {
-			http.Error(w, "Failed to save to ElasticSearch", http.StatusInternalServerError)
-		}
+	newUser := User{Username: user.Username, Age: user.Age, Gender: user.Gender}
+	if err := addUser(r.Context(), userStore, newUser, user.Password); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
 	w.Write([]byte("User added successfully."))
 }
 
-/**
- *  Helper functions:
- */
-// Function that searches database-ES to check if this user existes in db.
-func checkUser(username, password string) error {
-	client, err := elastic.NewClient(elastic.SetURL(ES_URL), elastic.SetSniff(false))
+// UserStore persists users under their username.
+type UserStore interface {
+	// Create saves a new user, or returns ErrUserExists if the username is taken, even by a user being
+	// created at the same time.
+	Create(ctx context.Context, user User) error
+	// Get returns ErrNotFound if there is no such user.
+	Get(ctx context.Context, username string) (*User, error)
+	// Update changes some fields of a user, named as in JSON, e.g. {"disabled": true}. A nil value
+	// removes the field.
+	Update(ctx context.Context, username string, fields map[string]interface{}) error
+}
+
+// The users of the service, set up in main (and connectES for the CLI).
+var userStore UserStore
+
+// ESUserStore keeps users in the user index, with their username as document id.
+type ESUserStore struct {
+	client *elastic.Client
+}
+
+func (s ESUserStore) Get(ctx context.Context, username string) (*User, error) {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	res, err := s.client.Get().
+		Index(USER_INDEX).
+		Type(USER_TYPE).
+		Id(username).
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	var user User
+	if err := json.Unmarshal(*res.Source, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// The document is created with op_type=create, so of two signups racing for the same name ES lets
+// exactly one through.
+func (s ESUserStore) Create(ctx context.Context, user User) error {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	_, err := s.client.Index().
+		Index(USER_INDEX).
+		Type(USER_TYPE).
+		Id(user.Username).
+		OpType("create").
+		BodyJson(user).
+		Refresh("wait_for").
+		Do(ctx)
+	return createUserError(err)
+}
+
+// The error of indexing a new user with op_type create: ES answers 409 if the username is taken, which
+// is what makes concurrent signups for one username safe.
+func createUserError(err error) error {
+	if elastic.IsConflict(err) {
+		return ErrUserExists
 	}
+	return err
+}
 
-	// select * from users where username = ?
-	query := elastic.NewTermQuery("username", username)
+func (s ESUserStore) Update(ctx context.Context, username string, fields map[string]interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
 
-	searchResult, err := client.Search().
+	_, err := s.client.Update().
 		Index(USER_INDEX).
-		Query(query).
-		Pretty(true).
-		Do(context.Background()) // this will create a new Go routine to finish HTTP request.
+		Type(USER_TYPE).
+		Id(username).
+		Doc(fields).
+		Refresh("wait_for").
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// MemoryUserStore keeps users in this process, for tests and local runs.
+type MemoryUserStore struct {
+	mu    sync.Mutex
+	users map[string]User
+}
+
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{users: make(map[string]User)}
+}
+
+func (s *MemoryUserStore) Create(ctx context.Context, user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[user.Username]; ok {
+		return ErrUserExists
+	}
+	s.users[user.Username] = user
+	return nil
+}
+
+func (s *MemoryUserStore) Get(ctx context.Context, username string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &user, nil
+}
+
+// The fields are merged into the JSON of the user, like ES merges a partial document.
+func (s *MemoryUserStore) Update(ctx context.Context, username string, fields map[string]interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok {
+		return ErrNotFound
+	}
+	js, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(js, &doc); err != nil {
+		return err
+	}
+	for k, v := range fields {
+		doc[k] = v
+	}
+	if js, err = json.Marshal(doc); err != nil {
+		return err
+	}
+	var updated User
+	if err := json.Unmarshal(js, &updated); err != nil {
+		return err
+	}
+	s.users[username] = updated
+	return nil
+}
+
+/**
+ *  Helper functions:
+ */
+// Function that checks a username and password against database-ES and records the login.
+func checkUser(ctx context.Context, store UserStore, username, password string) error {
+	user, err := store.Get(ctx, username)
+	if errors.Cause(err) == ErrNotFound {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return ErrWrongCredentials
+	}
 	if err != nil {
 		return err
 	}
+	if !user.checkPassword(password) {
+		return ErrWrongCredentials
+	}
+	if user.Disabled {
+		return ErrUserDisabled
+	}
 
-	var utyp User
-	// Iterate through everything that can be casted to type User in the result.
-	for _, item := range searchResult.Each(reflect.TypeOf(utyp)) {
-		if u, ok := item.(User); ok {
-			if username == u.Username && password == u.Password {
-				fmt.Printf("Login as %s\n", username)
-				return nil
-			}
+	fields := map[string]interface{}{"last_login": time.Now()}
+	if user.PasswordHash == "" {
+		hash, err := hashPassword(password)
+		if err != nil {
+			return err
 		}
+		fields["password_hash"] = hash
+		fields["legacy_password"] = nil
+	}
+	// The login itself already succeeded, a failed bookkeeping write should not undo it.
+	if err := store.Update(ctx, username, fields); err != nil {
+		fmt.Printf("Failed to record login of %s %v.\n", username, err)
 	}
 
-	return errors.New("Wrong username or password")
+	fmt.Printf("Login as %s\n", username)
+	return nil
 }
 
-// Function that saves a new user in database-ES.
-func addUser(user User) error {
-	client, err := elastic.NewClient(elastic.SetURL(ES_URL), elastic.SetSniff(false))
-	if err != nil {
-		return err
+// Check password against the stored hash, or against the plain text password of a legacy user.
+func (u *User) checkPassword(password string) bool {
+	if u.PasswordHash != "" {
+		return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
 	}
+	return u.LegacyPassword != "" && subtle.ConstantTimeCompare([]byte(u.LegacyPassword), []byte(password)) == 1
+}
 
-	// select * from users where username = ?
-	query := elastic.NewTermQuery("username", user.Username)
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
 
-	searchResult, err := client.Search().
-		Index(USER_INDEX).
-		Query(query).
-		Pretty(true).
-		Do(context.Background())
+// Function that saves a new user with a hash of their password. It returns ErrUserExists if the
+// username is taken.
+func addUser(ctx context.Context, store UserStore, user User, password string) error {
+	hash, err := hashPassword(password)
 	if err != nil {
 		return err
 	}
+	user.PasswordHash = hash
+	user.Created = time.Now()
+
+	if err := store.Create(ctx, user); err != nil {
+		return err
+	}
+
+	fmt.Printf("User is added: %s\n", user.Username)
+	return nil
+}
+
+// Function that returns every user, ordered by username.
+func listUsers(ctx context.Context, client *elastic.Client) ([]User, error) {
+	var users []User
+	scroll := client.Scroll(USER_INDEX).Size(500)
+	defer scroll.Clear(context.Background())
+	for {
+		pageCtx, cancel := context.WithTimeout(ctx, esTimeout)
+		searchResult, err := scroll.Do(pageCtx)
+		cancel()
+		if err == io.EOF {
+			sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+			return users, nil
+		}
+		if err != nil {
+			return nil, err
+		}
 
-	if searchResult.TotalHits() > 0 {
-		return errors.New("User already exists")
+		var utyp User
+		for _, item := range searchResult.Each(reflect.TypeOf(utyp)) {
+			if u, ok := item.(User); ok {
+				users = append(users, u)
+			}
+		}
 	}
+}
 
-	// Save to ES.
-	_, err = client.Index().
+// Function that disables or re-enables a user. Tokens handed out before stay valid until they expire.
+func setUserDisabled(ctx context.Context, store UserStore, username string, disabled bool) error {
+	return store.Update(ctx, username, map[string]interface{}{"disabled": disabled})
+}
+
+// Function that removes a user, their follows, saved areas and notifications from database-ES. Their
+// posts are kept.
+func deleteUser(ctx context.Context, client *elastic.Client, username string) error {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	_, err := client.Delete().
 		Index(USER_INDEX).
 		Type(USER_TYPE).
-		Id(user.Username).
-		BodyJson(user).
+		Id(username).
 		Refresh("wait_for").
-		Do(context.Background())
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return ErrNotFound
+	}
 	if err != nil {
 		return err
 	}
+	if err := deleteFollows(ctx, client, username); err != nil {
+		return err
+	}
+	if err := deleteAlerts(ctx, client, username); err != nil {
+		return err
+	}
 
-	fmt.Printf("User is added: %s\n", user.Username)
+	fmt.Printf("User is deleted: %s\n", username)
 	return nil
 }
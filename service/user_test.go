@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/olivere/elastic"
+	"github.com/pkg/errors"
+)
+
+func TestAddUserConcurrentSignups(t *testing.T) {
+	const n = 20
+	store := NewMemoryUserStore()
+
+	errs := make([]error, n)
+	var start, wg sync.WaitGroup
+	start.Add(1)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			start.Wait()
+			errs[i] = addUser(context.Background(), store, User{Username: "alice", Age: int64(20 + i)}, "password")
+		}(i)
+	}
+	start.Done()
+	wg.Wait()
+
+	created := 0
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			created++
+		case errors.Cause(err) != ErrUserExists:
+			t.Errorf("signup %d: got %v, want nil or ErrUserExists", i, err)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("%d signups succeeded, want exactly 1", created)
+	}
+
+	user, err := store.Get(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.checkPassword("password") {
+		t.Error("the stored user does not accept its password")
+	}
+}
+
+func TestMemoryUserStoreUpdate(t *testing.T) {
+	store := NewMemoryUserStore()
+	ctx := context.Background()
+	if err := store.Update(ctx, "bob", map[string]interface{}{"disabled": true}); err != ErrNotFound {
+		t.Fatalf("update of a missing user: got %v, want ErrNotFound", err)
+	}
+	if err := store.Create(ctx, User{Username: "bob", LegacyPassword: "old"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Update(ctx, "bob", map[string]interface{}{"disabled": true, "legacy_password": nil}); err != nil {
+		t.Fatal(err)
+	}
+	user, err := store.Get(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.Disabled || user.LegacyPassword != "" {
+		t.Errorf("got %+v, want disabled without legacy password", user)
+	}
+}
+
+func TestCreateUserError(t *testing.T) {
+	conflict := &elastic.Error{Status: http.StatusConflict}
+	if err := createUserError(conflict); err != ErrUserExists {
+		t.Errorf("a 409 from ES: got %v, want ErrUserExists", err)
+	}
+	other := &elastic.Error{Status: http.StatusInternalServerError}
+	if err := createUserError(other); err != other {
+		t.Errorf("a 500 from ES: got %v, want it unchanged", err)
+	}
+	if err := createUserError(nil); err != nil {
+		t.Errorf("no error: got %v", err)
+	}
+}
+
+func TestCheckUser(t *testing.T) {
+	store := NewMemoryUserStore()
+	ctx := context.Background()
+	if err := addUser(ctx, store, User{Username: "carol", Age: 30}, "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkUser(ctx, store, "carol", "password"); err != nil {
+		t.Errorf("right password: got %v, want nil", err)
+	}
+	// A wrong password and a missing user look the same to the client.
+	if err := checkUser(ctx, store, "carol", "wrong"); err != ErrWrongCredentials {
+		t.Errorf("wrong password: got %v, want ErrWrongCredentials", err)
+	}
+	if err := checkUser(ctx, store, "dave", "password"); err != ErrWrongCredentials {
+		t.Errorf("missing user: got %v, want ErrWrongCredentials", err)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+// This module validates request parameters before they reach ElasticSearch. Every problem is reported
+// against the field it was found in, so clients can show the message next to the right input
+// (see writeError for the response format).
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	MAX_RANGE_KM       = 1000.0 // largest search radius a client may ask for.
+	MAX_MESSAGE_LENGTH = 1000   // max number of characters in a post message.
+	MAX_AGE            = 150
+	DEFAULT_PAGE_SIZE  = 20  // items per page of a paginated list.
+	MAX_PAGE_SIZE      = 100 // largest page a client may ask for.
+)
+
+// FieldError describes what is wrong with one request parameter.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError collects every FieldError found in a request.
+type ValidationError struct {
+	Fields []FieldError `json:"fields"`
+}
+
+func (v *ValidationError) Error() string {
+	msgs := make([]string, len(v.Fields))
+	for i, f := range v.Fields {
+		msgs[i] = f.Field + " " + f.Message
+	}
+	return "invalid request: " + strings.Join(msgs, ", ")
+}
+
+// Record a problem with a field.
+func (v *ValidationError) Add(field, message string) {
+	v.Fields = append(v.Fields, FieldError{Field: field, Message: message})
+}
+
+// Return the collected problems as an error, or nil if the request is valid.
+func (v *ValidationError) Err() error {
+	if len(v.Fields) == 0 {
+		return nil
+	}
+	return v
+}
+
+// Parse a required coordinate and check it lies within [-limit, limit].
+func (v *ValidationError) Coordinate(field, val string, limit float64) float64 {
+	if val == "" {
+		v.Add(field, "is required")
+		return 0
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		v.Add(field, "must be a number")
+		return 0
+	}
+	// Written this way round so that NaN fails too.
+	if !(f >= -limit && f <= limit) {
+		v.Add(field, fmt.Sprintf("must be between %g and %g", -limit, limit))
+		return 0
+	}
+	return f
+}
+
+// Parse a latitude/longitude pair.
+func (v *ValidationError) Location(lat, lon string) Location {
+	return Location{
+		Lat: v.Coordinate("lat", lat, 90),
+		Lon: v.Coordinate("lon", lon, 180),
+	}
+}
+
+// Parse an optional search radius in kilometers into the distance format ElasticSearch expects.
+func (v *ValidationError) Range(field, val string) string {
+	if val == "" {
+		return DISTANCE
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		v.Add(field, "must be a number of kilometers")
+		return DISTANCE
+	}
+	if !(f > 0 && f <= MAX_RANGE_KM) {
+		v.Add(field, fmt.Sprintf("must be greater than 0 and at most %g", MAX_RANGE_KM))
+		return DISTANCE
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64) + "km"
+}
+
+// Check a post message is not oversized.
+func (v *ValidationError) Message(field, val string) string {
+	return v.Text(field, val, MAX_MESSAGE_LENGTH)
+}
+
+// Check a free text field is not oversized.
+func (v *ValidationError) Text(field, val string, max int) string {
+	if n := utf8.RuneCountInString(val); n > max {
+		v.Add(field, fmt.Sprintf("must be at most %d characters, got %d", max, n))
+	}
+	return val
+}
+
+// Check an age is plausible, 0 means not given.
+func (v *ValidationError) Age(field string, val int64) int64 {
+	if val < 0 || val > MAX_AGE {
+		v.Add(field, fmt.Sprintf("must be between 0 and %d", MAX_AGE))
+	}
+	return val
+}
+
+// Parse an optional page size.
+func (v *ValidationError) Limit(field, val string) int {
+	if val == "" {
+		return DEFAULT_PAGE_SIZE
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil || n < 1 || n > MAX_PAGE_SIZE {
+		v.Add(field, fmt.Sprintf("must be a number between 1 and %d", MAX_PAGE_SIZE))
+		return DEFAULT_PAGE_SIZE
+	}
+	return n
+}
+
+// Parse an optional cursor returned with the previous page, see encodeCursor. A missing cursor means the
+// first page and is returned as nil.
+func (v *ValidationError) Cursor(field, val string) []interface{} {
+	if val == "" {
+		return nil
+	}
+	js, err := base64.RawURLEncoding.DecodeString(val)
+	var after []interface{}
+	if err == nil {
+		// Keep numbers as they were, sort values such as dates in milliseconds must round trip exactly.
+		dec := json.NewDecoder(bytes.NewReader(js))
+		dec.UseNumber()
+		err = dec.Decode(&after)
+	}
+	if err != nil || len(after) == 0 {
+		v.Add(field, "is not a cursor returned by this service")
+		return nil
+	}
+	return after
+}
+
+// Turn the sort values of the last item of a page into the cursor of the next page. Clients treat it as
+// an opaque string.
+func encodeCursor(sort []interface{}) string {
+	js, _ := json.Marshal(sort)
+	return base64.RawURLEncoding.EncodeToString(js)
+}
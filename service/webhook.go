@@ -0,0 +1,769 @@
+package main
+
+// This module tells downstream systems about posts as they are created and deleted, through webhooks
+// registered by admins:
+//
+//	POST   /api/v1/admin/webhooks                      register {"url", "secret", "events", "area"}
+//	GET    /api/v1/admin/webhooks                      every webhook, without secrets
+//	DELETE /api/v1/admin/webhooks/{id}
+//	GET    /api/v1/admin/webhooks/{id}/deliveries      delivery log, newest first (?status=dead for the
+//	                                                   dead letters)
+//	POST   /api/v1/admin/webhooks/deliveries/{id}/retry   send a dead letter again
+//
+// events lists "post.created" and/or "post.deleted", area is optional and takes the circle or box of
+// /stream. A secret is generated when none is given, and only shown in the answer of the POST.
+//
+// Each delivery is a POST of {"id", "type", "time", "post"} with the headers X-Webhook-Event,
+// X-Webhook-Delivery, X-Webhook-Timestamp and X-Webhook-Signature, which is "sha256=" followed by the
+// hex HMAC-SHA256 of "<timestamp>.<body>" with the secret. Receivers should check it and reject old
+// timestamps. Deliveries are stored in the delivery index before they are sent, and sent by workers:
+// an answer other than 2xx is retried with exponential backoff, WEBHOOK_MAX_ATTEMPTS times in all,
+// then the delivery is dead. Every instance polls for deliveries that are due, so retries survive
+// restarts; claiming a delivery is one scripted update, so only one instance sends each attempt.
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/olivere/elastic"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	WEBHOOK_INDEX  = "webhook"
+	WEBHOOK_TYPE   = "webhook"
+	DELIVERY_INDEX = "delivery"
+	DELIVERY_TYPE  = "delivery"
+
+	MAX_WEBHOOKS         = 100
+	WEBHOOK_MAX_ATTEMPTS = 8
+	WEBHOOK_BACKOFF      = 10 * time.Second // wait before the first retry, doubled for every next one.
+	WEBHOOK_MAX_BACKOFF  = time.Hour
+	WEBHOOK_TIMEOUT      = 10 * time.Second // for the receiver to answer.
+	WEBHOOK_POLL         = 5 * time.Second  // how often due deliveries are looked for.
+	WEBHOOK_QUEUE_SIZE   = 1000
+	WEBHOOK_WORKERS      = 4
+
+	DELIVERY_PENDING   = "pending"
+	DELIVERY_FAILED    = "failed" // will be retried.
+	DELIVERY_DELIVERED = "delivered"
+	DELIVERY_DEAD      = "dead"
+)
+
+var webhookEvents = []string{"post." + POST_CREATED, "post." + POST_DELETED}
+
+var (
+	webhooksDelivered = expvar.NewInt("webhooks_delivered")
+	webhooksFailed    = expvar.NewInt("webhooks_failed")
+	webhooksDead      = expvar.NewInt("webhooks_dead")
+)
+
+// Webhook is a downstream system that wants to hear about posts.
+type Webhook struct {
+	Id      string       `json:"id"`
+	Url     string       `json:"url"`
+	Secret  string       `json:"secret,omitempty"`
+	Events  []string     `json:"events"`
+	Area    *AreaRequest `json:"area,omitempty"`
+	Created time.Time    `json:"created"`
+}
+
+// WebhookList is the answer of GET /admin/webhooks.
+type WebhookList struct {
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+// WebhookPayload is the body of a delivery.
+type WebhookPayload struct {
+	Id   string    `json:"id"` // of the delivery, the same for every attempt.
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Post *Post     `json:"post"`
+}
+
+// Delivery is one event to send to one webhook, and how sending it went.
+type Delivery struct {
+	Id          string     `json:"id"`
+	WebhookId   string     `json:"webhook_id"`
+	Event       string     `json:"event"`
+	PostId      string     `json:"post_id"`
+	Payload     string     `json:"payload"` // the exact body, so that every attempt signs the same bytes.
+	Status      string     `json:"status"`
+	Attempts    int        `json:"attempts"`
+	NextAttempt time.Time  `json:"next_attempt"`
+	LastCode    int        `json:"last_code,omitempty"` // HTTP status of the last answer.
+	LastError   string     `json:"last_error,omitempty"`
+	Created     time.Time  `json:"created"`
+	Delivered   *time.Time `json:"delivered,omitempty"`
+}
+
+// DeliveryPage is one page of the delivery log.
+type DeliveryPage struct {
+	Deliveries []Delivery `json:"deliveries"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+// Takes a due delivery for one attempt: the next attempt is pushed past the time it may take, so that
+// no other instance picks it up meanwhile, and the attempt is counted. Does nothing if another instance
+// got there first.
+const DELIVERY_CLAIM_SCRIPT = `
+if (ctx._source.attempts != params.attempts || ctx._source.status == 'delivered' || ctx._source.status == 'dead') {
+	ctx.op = 'none';
+} else {
+	ctx._source.attempts += 1;
+	ctx._source.next_attempt = params.lease;
+}
+`
+
+// Handler for GET and POST on /admin/webhooks.
+func handlerWebhooks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
+	w.Header().Set("Access-Control-Allow-Methods", "GET,POST")
+
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	if !isAdmin(getUsername(r)) {
+		writeError(w, r, ErrForbidden)
+		return
+	}
+
+	if r.Method == "GET" {
+		hooks, err := listWebhooks(r.Context(), esClient, "")
+		if err != nil {
+			writeError(w, r, internalError("Failed to read webhooks from ElasticSearch", err))
+			return
+		}
+		for i := range hooks {
+			hooks[i].Secret = ""
+		}
+		js, err := json.Marshal(WebhookList{Webhooks: hooks})
+		if err != nil {
+			writeError(w, r, internalError("Failed to parse webhooks into JSON format", err))
+			return
+		}
+		w.Write(js)
+		return
+	}
+
+	var hook Webhook
+	if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+		writeError(w, r, badRequest("invalid_json", "Failed to parse JSON input from client", err))
+		return
+	}
+	if err := hook.validate(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := saveWebhook(r.Context(), esClient, &hook); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	js, err := json.Marshal(hook)
+	if err != nil {
+		writeError(w, r, internalError("Failed to parse webhook into JSON format", err))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
+}
+
+// Handler for DELETE /admin/webhooks/{id}, answers 204. Deliveries still due are dropped when they are
+// next tried.
+func handlerWebhook(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
+	w.Header().Set("Access-Control-Allow-Methods", "DELETE")
+
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	if !isAdmin(getUsername(r)) {
+		writeError(w, r, ErrForbidden)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), esTimeout)
+	defer cancel()
+	_, err := esClient.Delete().
+		Index(WEBHOOK_INDEX).
+		Type(WEBHOOK_TYPE).
+		Id(mux.Vars(r)["id"]).
+		Refresh("wait_for").
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		err = ErrNotFound
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler for GET /admin/webhooks/{id}/deliveries.
+func handlerDeliveries(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
+
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	if !isAdmin(getUsername(r)) {
+		writeError(w, r, ErrForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	var v ValidationError
+	limit := v.Limit("limit", query.Get("limit"))
+	after := v.Cursor("cursor", query.Get("cursor"))
+	status := query.Get("status")
+	switch status {
+	case "", DELIVERY_PENDING, DELIVERY_FAILED, DELIVERY_DELIVERED, DELIVERY_DEAD:
+	default:
+		v.Add("status", "must be pending, failed, delivered or dead")
+	}
+	if err := v.Err(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	deliveries, next, err := listDeliveries(r.Context(), esClient, mux.Vars(r)["id"], status, after, limit)
+	if err != nil {
+		writeError(w, r, internalError("Failed to read deliveries from ElasticSearch", err))
+		return
+	}
+	page := DeliveryPage{Deliveries: deliveries}
+	if next != nil {
+		page.NextCursor = encodeCursor(next)
+	}
+	js, err := json.Marshal(page)
+	if err != nil {
+		writeError(w, r, internalError("Failed to parse deliveries into JSON format", err))
+		return
+	}
+	w.Write(js)
+}
+
+// Handler for POST /admin/webhooks/deliveries/{id}/retry, answers 204. The delivery is sent again
+// from scratch, with all its attempts.
+func handlerRetryDelivery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
+
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	if !isAdmin(getUsername(r)) {
+		writeError(w, r, ErrForbidden)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	d, err := getDelivery(r.Context(), esClient, id)
+	if err == nil && d.Status != DELIVERY_DEAD {
+		err = badRequest("not_dead", "Only dead deliveries can be retried", nil)
+	}
+	if err == nil {
+		err = updateDelivery(r.Context(), esClient, id, map[string]interface{}{
+			"status":       DELIVERY_PENDING,
+			"attempts":     0,
+			"next_attempt": time.Now(),
+		})
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	webhooks.Queue(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Check a webhook sent by a client, and fill in its id, creation date and secret if it has none.
+func (hook *Webhook) validate() error {
+	var v ValidationError
+	if req, err := http.NewRequest("POST", hook.Url, nil); err != nil || (req.URL.Scheme != "http" && req.URL.Scheme != "https") || req.URL.Host == "" {
+		v.Add("url", "must be an http or https url")
+	}
+	if len(hook.Events) == 0 {
+		v.Add("events", "is required")
+	}
+	for _, e := range hook.Events {
+		if e != webhookEvents[0] && e != webhookEvents[1] {
+			v.Add("events", fmt.Sprintf("must be %s or %s", webhookEvents[0], webhookEvents[1]))
+		}
+	}
+	if hook.Area != nil {
+		if _, err := hook.Area.area(); err != nil {
+			v.Fields = append(v.Fields, err.(*ValidationError).Fields...)
+		}
+	}
+	if err := v.Err(); err != nil {
+		return err
+	}
+
+	if hook.Secret == "" {
+		buf := make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+			return err
+		}
+		hook.Secret = hex.EncodeToString(buf)
+	}
+	hook.Id = uuid.New()
+	hook.Created = time.Now()
+	return nil
+}
+
+// Check if the webhook wants to hear about an event of a post.
+func (hook *Webhook) wants(p *Post) bool {
+	if hook.Area == nil {
+		return true
+	}
+	a, err := hook.Area.area()
+	return err == nil && a.contains(p.Location)
+}
+
+// The signature of a delivery body, see the top of this module.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// The wait before the attempt after the given number of failed ones.
+func webhookBackoff(attempts int) time.Duration {
+	d := WEBHOOK_BACKOFF
+	for i := 1; i < attempts && d < WEBHOOK_MAX_BACKOFF; i++ {
+		d *= 2
+	}
+	if d > WEBHOOK_MAX_BACKOFF {
+		d = WEBHOOK_MAX_BACKOFF
+	}
+	return d
+}
+
+// WebhookDispatcher turns post events into deliveries and sends them in the background.
+type WebhookDispatcher struct {
+	client *http.Client
+	queue  chan string // ids of deliveries to try now.
+}
+
+// The dispatcher handlerPost and handlerDeletePost hand events to.
+var webhooks = NewWebhookDispatcher(WEBHOOK_WORKERS)
+
+func NewWebhookDispatcher(workers int) *WebhookDispatcher {
+	d := &WebhookDispatcher{
+		client: &http.Client{Timeout: WEBHOOK_TIMEOUT},
+		queue:  make(chan string, WEBHOOK_QUEUE_SIZE),
+	}
+	for i := 0; i < workers; i++ {
+		go d.run()
+	}
+	return d
+}
+
+// Record a delivery for every webhook that wants the event, and queue them. The deliveries are
+// recorded in the background, an event that cannot be goes to the outbox.
+func (d *WebhookDispatcher) Publish(e PostEvent) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), esTimeout*(STEP_RETRIES+1))
+		defer cancel()
+		err := runStep(ctx, "webhooks", func(ctx context.Context) error {
+			return d.record(ctx, esClient, e)
+		})
+		if err != nil {
+			fmt.Printf("Failed to record webhook deliveries for post %s %v.\n", e.Id, err)
+			recordOutbox(OutboxEntry{PostId: e.Id, Action: "webhooks." + e.Type, Post: e.Post, Error: err.Error(), Time: e.Time})
+		}
+	}()
+}
+
+// Try a delivery as soon as a worker is free. If the queue is full the poller picks it up later.
+func (d *WebhookDispatcher) Queue(id string) {
+	select {
+	case d.queue <- id:
+	default:
+	}
+}
+
+// Poll for due deliveries every WEBHOOK_POLL for as long as the service runs.
+func (d *WebhookDispatcher) Start() {
+	go func() {
+		for range time.Tick(WEBHOOK_POLL) {
+			ids, err := dueDeliveries(context.Background(), esClient, WEBHOOK_QUEUE_SIZE-len(d.queue))
+			if err != nil {
+				fmt.Printf("Failed to read due webhook deliveries %v.\n", err)
+				continue
+			}
+			for _, id := range ids {
+				d.Queue(id)
+			}
+		}
+	}()
+}
+
+func (d *WebhookDispatcher) run() {
+	for id := range d.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), WEBHOOK_TIMEOUT+4*esTimeout)
+		if err := d.attempt(ctx, esClient, id); err != nil {
+			fmt.Printf("Failed to attempt webhook delivery %s %v.\n", id, err)
+		}
+		cancel()
+	}
+}
+
+// Create the deliveries of an event. Their ids are derived from the event, so recording it again only
+// creates the ones missing.
+func (d *WebhookDispatcher) record(ctx context.Context, client *elastic.Client, e PostEvent) error {
+	event := "post." + e.Type
+	hooks, err := listWebhooks(ctx, client, event)
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range hooks {
+		if !hook.wants(e.Post) {
+			continue
+		}
+		id := hook.Id + ":" + e.Type + ":" + e.Id
+		payload, err := json.Marshal(WebhookPayload{Id: id, Type: event, Time: e.Time, Post: e.Post})
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		delivery := Delivery{
+			Id:          id,
+			WebhookId:   hook.Id,
+			Event:       event,
+			PostId:      e.Id,
+			Payload:     string(payload),
+			Status:      DELIVERY_PENDING,
+			NextAttempt: now,
+			Created:     now,
+		}
+
+		indexCtx, cancel := context.WithTimeout(ctx, esTimeout)
+		_, err = client.Index().
+			Index(DELIVERY_INDEX).
+			Type(DELIVERY_TYPE).
+			Id(id).
+			OpType("create").
+			BodyJson(delivery).
+			Do(indexCtx)
+		cancel()
+		if elastic.IsConflict(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		d.Queue(id)
+	}
+	return nil
+}
+
+// Make one attempt at a delivery, if it is still due and no other instance is making it.
+func (d *WebhookDispatcher) attempt(ctx context.Context, client *elastic.Client, id string) error {
+	delivery, err := getDelivery(ctx, client, id)
+	if errors.Cause(err) == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if delivery.Status == DELIVERY_DELIVERED || delivery.Status == DELIVERY_DEAD || delivery.NextAttempt.After(time.Now()) {
+		return nil
+	}
+
+	claimCtx, cancel := context.WithTimeout(ctx, esTimeout)
+	res, err := client.Update().
+		Index(DELIVERY_INDEX).
+		Type(DELIVERY_TYPE).
+		Id(id).
+		Script(elastic.NewScript(DELIVERY_CLAIM_SCRIPT).Params(map[string]interface{}{
+			"attempts": delivery.Attempts,
+			"lease":    time.Now().Add(WEBHOOK_TIMEOUT + 4*esTimeout),
+		})).
+		Do(claimCtx)
+	cancel()
+	if err != nil {
+		return err
+	}
+	if res.Result == "noop" {
+		return nil // another instance is on it.
+	}
+	delivery.Attempts++
+
+	hook, err := getWebhook(ctx, client, delivery.WebhookId)
+	if errors.Cause(err) == ErrNotFound {
+		webhooksDead.Add(1)
+		return updateDelivery(ctx, client, id, map[string]interface{}{"status": DELIVERY_DEAD, "last_error": "webhook was deleted"})
+	}
+	if err != nil {
+		return err
+	}
+
+	return updateDelivery(ctx, client, id, d.deliver(ctx, hook, delivery))
+}
+
+// Send a delivery whose attempt was just counted, and record how it went in it: delivered, failed with
+// the next attempt after webhookBackoff, or dead after WEBHOOK_MAX_ATTEMPTS. It returns the fields that
+// changed, to store.
+func (d *WebhookDispatcher) deliver(ctx context.Context, hook *Webhook, delivery *Delivery) map[string]interface{} {
+	code, err := d.send(ctx, hook, delivery)
+	now := time.Now()
+	delivery.LastCode = code
+	delivery.LastError = ""
+	switch {
+	case err == nil:
+		webhooksDelivered.Add(1)
+		delivery.Status = DELIVERY_DELIVERED
+		delivery.Delivered = &now
+	case delivery.Attempts >= WEBHOOK_MAX_ATTEMPTS:
+		webhooksDead.Add(1)
+		fmt.Printf("Webhook delivery %s is dead after %d attempts: %v\n", delivery.Id, delivery.Attempts, err)
+		delivery.Status = DELIVERY_DEAD
+		delivery.LastError = err.Error()
+	default:
+		webhooksFailed.Add(1)
+		delivery.Status = DELIVERY_FAILED
+		delivery.LastError = err.Error()
+		delivery.NextAttempt = now.Add(webhookBackoff(delivery.Attempts))
+	}
+
+	fields := map[string]interface{}{
+		"status":     delivery.Status,
+		"last_code":  delivery.LastCode,
+		"last_error": delivery.LastError,
+	}
+	if delivery.Delivered != nil {
+		fields["delivered"] = delivery.Delivered
+	}
+	if delivery.Status == DELIVERY_FAILED {
+		fields["next_attempt"] = delivery.NextAttempt
+	}
+	return fields
+}
+
+// POST a delivery to its webhook. It returns the HTTP status of the answer, 0 if there was none.
+func (d *WebhookDispatcher) send(ctx context.Context, hook *Webhook, delivery *Delivery) (int, error) {
+	body := []byte(delivery.Payload)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequest("POST", hook.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-Delivery", delivery.Id)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", signWebhook(hook.Secret, timestamp, body))
+
+	res, err := d.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 4096)) // lets the connection be reused.
+	if res.StatusCode/100 != 2 {
+		return res.StatusCode, fmt.Errorf("webhook answered %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+/**
+ *  Helper functions:
+ */
+// Function that saves a new webhook, unless there are too many already.
+func saveWebhook(ctx context.Context, client *elastic.Client, hook *Webhook) error {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	n, err := client.Count(WEBHOOK_INDEX).Do(ctx)
+	if err != nil {
+		return err
+	}
+	if n >= MAX_WEBHOOKS {
+		return badRequest("too_many_webhooks", fmt.Sprintf("There cannot be more than %d webhooks", MAX_WEBHOOKS), nil)
+	}
+
+	_, err = client.Index().
+		Index(WEBHOOK_INDEX).
+		Type(WEBHOOK_TYPE).
+		Id(hook.Id).
+		BodyJson(hook).
+		Refresh("wait_for").
+		Do(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Webhook is saved to index: %s\n", hook.Url)
+	return nil
+}
+
+// Function that reads the webhooks, only those that want event if it is not empty.
+func listWebhooks(ctx context.Context, client *elastic.Client, event string) ([]Webhook, error) {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	search := client.Search().
+		Index(WEBHOOK_INDEX).
+		SortBy(elastic.NewFieldSort("created").Asc()).
+		Size(MAX_WEBHOOKS)
+	if event != "" {
+		search = search.Query(elastic.NewTermQuery("events", event))
+	}
+	searchResult, err := search.Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := make([]Webhook, 0, len(searchResult.Hits.Hits))
+	for _, hit := range searchResult.Hits.Hits {
+		var hook Webhook
+		if err := json.Unmarshal(*hit.Source, &hook); err != nil {
+			return nil, errors.Wrapf(err, "webhook %s", hit.Id)
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
+
+func getWebhook(ctx context.Context, client *elastic.Client, id string) (*Webhook, error) {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	res, err := client.Get().Index(WEBHOOK_INDEX).Type(WEBHOOK_TYPE).Id(id).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var hook Webhook
+	if err := json.Unmarshal(*res.Source, &hook); err != nil {
+		return nil, errors.Wrapf(err, "webhook %s", id)
+	}
+	return &hook, nil
+}
+
+func getDelivery(ctx context.Context, client *elastic.Client, id string) (*Delivery, error) {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	res, err := client.Get().Index(DELIVERY_INDEX).Type(DELIVERY_TYPE).Id(id).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var delivery Delivery
+	if err := json.Unmarshal(*res.Source, &delivery); err != nil {
+		return nil, errors.Wrapf(err, "delivery %s", id)
+	}
+	return &delivery, nil
+}
+
+func updateDelivery(ctx context.Context, client *elastic.Client, id string, fields map[string]interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	_, err := client.Update().
+		Index(DELIVERY_INDEX).
+		Type(DELIVERY_TYPE).
+		Id(id).
+		Doc(fields).
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Function that returns the ids of up to limit deliveries whose next attempt is due, the most overdue
+// first.
+func dueDeliveries(ctx context.Context, client *elastic.Client, limit int) ([]string, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	searchResult, err := client.Search().
+		Index(DELIVERY_INDEX).
+		Query(elastic.NewBoolQuery().Filter(
+			elastic.NewTermsQuery("status", DELIVERY_PENDING, DELIVERY_FAILED),
+			elastic.NewRangeQuery("next_attempt").Lte(time.Now()),
+		)).
+		SortBy(elastic.NewFieldSort("next_attempt").Asc()).
+		Size(limit).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(searchResult.Hits.Hits))
+	for i, hit := range searchResult.Hits.Hits {
+		ids[i] = hit.Id
+	}
+	return ids, nil
+}
+
+// Function that reads one page of the deliveries of a webhook, newest first, only those with status if
+// it is not empty.
+func listDeliveries(ctx context.Context, client *elastic.Client, webhookId, status string, after []interface{}, limit int) ([]Delivery, []interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, esTimeout)
+	defer cancel()
+
+	query := elastic.NewBoolQuery().Filter(elastic.NewTermQuery("webhook_id", webhookId))
+	if status != "" {
+		query = query.Filter(elastic.NewTermQuery("status", status))
+	}
+	search := client.Search().
+		Index(DELIVERY_INDEX).
+		Query(query).
+		SortBy(elastic.NewFieldSort("created").Desc(), elastic.NewFieldSort("id").Asc()).
+		Size(limit)
+	if after != nil {
+		search = search.SearchAfter(after...)
+	}
+	searchResult, err := search.Do(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	deliveries := make([]Delivery, 0, len(searchResult.Hits.Hits))
+	for _, hit := range searchResult.Hits.Hits {
+		var delivery Delivery
+		if err := json.Unmarshal(*hit.Source, &delivery); err != nil {
+			return nil, nil, errors.Wrapf(err, "delivery %s", hit.Id)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nextPage(searchResult, limit), nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver is an httptest server standing in for a webhook. It answers status and records the requests.
+type receiver struct {
+	*httptest.Server
+	status int
+
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newReceiver(status int) *receiver {
+	rc := &receiver{status: status}
+	rc.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		rc.mu.Lock()
+		rc.requests = append(rc.requests, r)
+		rc.bodies = append(rc.bodies, body)
+		rc.mu.Unlock()
+		w.WriteHeader(rc.status)
+	}))
+	return rc
+}
+
+func testDelivery() *Delivery {
+	return &Delivery{
+		Id:        "hook:created:post",
+		WebhookId: "hook",
+		Event:     "post.created",
+		PostId:    "post",
+		Payload:   `{"id":"hook:created:post","type":"post.created"}`,
+		Status:    DELIVERY_PENDING,
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	rc := newReceiver(http.StatusOK)
+	defer rc.Close()
+	hook := &Webhook{Id: "hook", Url: rc.URL, Secret: "s3cret"}
+	delivery := testDelivery()
+	delivery.Attempts = 1
+
+	NewWebhookDispatcher(0).deliver(context.Background(), hook, delivery)
+
+	if delivery.Status != DELIVERY_DELIVERED || delivery.LastCode != http.StatusOK || delivery.Delivered == nil {
+		t.Fatalf("got %+v, want delivered", delivery)
+	}
+	if len(rc.requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(rc.requests))
+	}
+	r, body := rc.requests[0], rc.bodies[0]
+	if string(body) != delivery.Payload {
+		t.Errorf("got body %s, want %s", body, delivery.Payload)
+	}
+	want := signWebhook(hook.Secret, r.Header.Get("X-Webhook-Timestamp"), body)
+	if got := r.Header.Get("X-Webhook-Signature"); got != want {
+		t.Errorf("got signature %q, want %q", got, want)
+	}
+	if signWebhook("other", r.Header.Get("X-Webhook-Timestamp"), body) == want {
+		t.Error("the signature does not depend on the secret")
+	}
+	if got := r.Header.Get("X-Webhook-Delivery"); got != delivery.Id {
+		t.Errorf("got delivery header %q, want %q", got, delivery.Id)
+	}
+	if got := r.Header.Get("X-Webhook-Event"); got != delivery.Event {
+		t.Errorf("got event header %q, want %q", got, delivery.Event)
+	}
+}
+
+func TestWebhookRetriesUntilDead(t *testing.T) {
+	rc := newReceiver(http.StatusServiceUnavailable)
+	defer rc.Close()
+	hook := &Webhook{Id: "hook", Url: rc.URL, Secret: "s3cret"}
+	delivery := testDelivery()
+	d := NewWebhookDispatcher(0)
+
+	for attempt := 1; attempt <= WEBHOOK_MAX_ATTEMPTS; attempt++ {
+		delivery.Attempts++ // what claiming the delivery does.
+		before := time.Now()
+		fields := d.deliver(context.Background(), hook, delivery)
+		after := time.Now()
+
+		if delivery.LastCode != http.StatusServiceUnavailable || delivery.LastError == "" {
+			t.Fatalf("attempt %d: got %+v, want the 503 recorded", attempt, delivery)
+		}
+		if attempt == WEBHOOK_MAX_ATTEMPTS {
+			if delivery.Status != DELIVERY_DEAD || fields["status"] != DELIVERY_DEAD {
+				t.Fatalf("attempt %d: got status %s, want dead", attempt, delivery.Status)
+			}
+			if _, ok := fields["next_attempt"]; ok {
+				t.Errorf("attempt %d: a dead delivery is scheduled again", attempt)
+			}
+			break
+		}
+
+		if delivery.Status != DELIVERY_FAILED {
+			t.Fatalf("attempt %d: got status %s, want failed", attempt, delivery.Status)
+		}
+		backoff := webhookBackoff(attempt)
+		if delivery.NextAttempt.Before(before.Add(backoff)) || delivery.NextAttempt.After(after.Add(backoff)) {
+			t.Errorf("attempt %d: next attempt in %v, want %v", attempt, delivery.NextAttempt.Sub(before), backoff)
+		}
+		if fields["next_attempt"] != delivery.NextAttempt {
+			t.Errorf("attempt %d: next attempt is not stored", attempt)
+		}
+	}
+
+	if len(rc.requests) != WEBHOOK_MAX_ATTEMPTS {
+		t.Errorf("got %d requests, want %d", len(rc.requests), WEBHOOK_MAX_ATTEMPTS)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	prev := time.Duration(0)
+	for attempts := 1; attempts <= 30; attempts++ {
+		got := webhookBackoff(attempts)
+		if got > WEBHOOK_MAX_BACKOFF {
+			t.Fatalf("webhookBackoff(%d) = %v, above WEBHOOK_MAX_BACKOFF", attempts, got)
+		}
+		if got < prev {
+			t.Fatalf("webhookBackoff(%d) = %v, shorter than for one attempt less", attempts, got)
+		}
+		if got < WEBHOOK_MAX_BACKOFF && prev != 0 && got != 2*prev {
+			t.Errorf("webhookBackoff(%d) = %v, want %v", attempts, got, 2*prev)
+		}
+		prev = got
+	}
+	if webhookBackoff(1) != WEBHOOK_BACKOFF {
+		t.Errorf("webhookBackoff(1) = %v, want %v", webhookBackoff(1), WEBHOOK_BACKOFF)
+	}
+	if webhookBackoff(30) != WEBHOOK_MAX_BACKOFF {
+		t.Errorf("webhookBackoff(30) = %v, want the cap %v", webhookBackoff(30), WEBHOOK_MAX_BACKOFF)
+	}
+}